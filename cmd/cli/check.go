@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"ohnitiel/prismatic/internal/db"
+	"ohnitiel/prismatic/internal/locale"
+
+	"github.com/urfave/cli/v3"
+)
+
+func checkCommand(l *locale.Locale) *cli.Command {
+	return &cli.Command{
+		Name:  "check",
+		Usage: l.CLI.Commands.Check,
+		Action: func(ctx context.Context, c *cli.Command) error {
+			ctx, cancel := withRunTimeout(ctx)
+			defer cancel()
+
+			manager, err := loadConnections(ctx, environment, connections)
+			if err != nil {
+				return err
+			}
+			defer manager.Close()
+
+			var mu sync.Mutex
+			states := make(map[string]*tls.ConnectionState)
+
+			executor := db.NewExecutor(manager)
+			failures := executor.ForEach(ctx, cfg.MaxWorkers,
+				func(ctx context.Context, name string, conn *db.Connection) error {
+					state, err := conn.TLSState(ctx)
+					if err != nil {
+						return err
+					}
+
+					mu.Lock()
+					states[name] = state
+					mu.Unlock()
+					return nil
+				},
+			)
+
+			printCheck(os.Stdout, states, failures)
+
+			return exitStatus(ctx, len(states), failures)
+		},
+	}
+}
+
+// Prints the TLS version and cipher negotiated by each connection
+func printCheck(w io.Writer, states map[string]*tls.ConnectionState, failures map[string]error) {
+	names := make([]string, 0, len(states)+len(failures))
+	for name := range states {
+		names = append(names, name)
+	}
+	for name := range failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	status := locale.L.CLI.CheckStatus
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\t%s\t%s\n", status.Connection, status.TLSVersion, status.Cipher)
+
+	for _, name := range names {
+		if err, ok := failures[name]; ok {
+			fmt.Fprintf(tw, "%s\t%s: %v\n", name, status.Error, err)
+			continue
+		}
+
+		state := states[name]
+		if state == nil {
+			fmt.Fprintf(tw, "%s\t%s\t\n", name, status.NotEncrypted)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name,
+			tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+
+	tw.Flush()
+}
@@ -2,18 +2,24 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"log/slog"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"slices"
 	"strings"
+	"syscall"
+	"time"
 
 	"ohnitiel/prismatic/internal/config"
 	"ohnitiel/prismatic/internal/db"
 	"ohnitiel/prismatic/internal/export"
 	"ohnitiel/prismatic/internal/locale"
+	"ohnitiel/prismatic/internal/secrets"
 
 	"github.com/urfave/cli/v3"
 )
@@ -22,11 +28,22 @@ const (
 	ExitCodeSuccess        = 0
 	ExitCodeFullFailure    = 101
 	ExitCodePartialFailure = 102
+	ExitCodeInvalidConfig  = 103
+	ExitCodeInterrupted    = 130
 )
 
+// Cause of the root context cancellation when a signal is received
+var errInterrupted = errors.New("interrupted")
+
 var (
 	outputFormats = []string{"xlsx", "json", "csv"}
 	cfg           *config.Config
+	configFile    string
+	environment   string
+	connections   []string
+	commit        bool
+	queryTimeout  time.Duration
+	runTimeout    time.Duration
 )
 
 func validateOutputFormat(format string, l *locale.Locale) error {
@@ -51,36 +68,139 @@ func verifyQueryArgument(query string) (string, error) {
 	return query, nil
 }
 
+// Cancels the returned context on SIGINT/SIGTERM so every in-flight
+// transaction is rolled back. A second signal forces the exit
+func withSignalHandling() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		slog.WarnContext(ctx, locale.L.Logs.InterruptReceived, "signal", sig)
+		fmt.Fprintln(os.Stderr, locale.L.Logs.InterruptReceived)
+		cancel(errInterrupted)
+
+		if _, ok := <-signals; ok {
+			os.Exit(ExitCodeInterrupted)
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(signals)
+		cancel(nil)
+	}
+}
+
+// Reports whether the run was cancelled by a signal
+func interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errInterrupted)
+}
+
+// Prints which connections were committed when the run was interrupted
+func reportInterruption(ctx context.Context, executor *db.Executor) {
+	if !interrupted(ctx) {
+		return
+	}
+
+	committed := executor.Committed()
+	if len(committed) == 0 {
+		fmt.Println(locale.L.Logs.NoneCommitted)
+		return
+	}
+	fmt.Printf(locale.L.Logs.CommittedBeforeInterrupt+"\n", strings.Join(committed, ", "))
+}
+
+// Bounds the whole run by the configured run timeout, if any
+func withRunTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cfg.RunTimeoutDuration > 0 {
+		return context.WithTimeout(ctx, cfg.RunTimeoutDuration)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Loads the connections selected by --connections in the given environment
+func loadConnections(ctx context.Context, environment string, connections []string) (*db.Manager, error) {
+	selection, err := config.ParseSelection(connections, cfg.Selections)
+	if err != nil {
+		return nil, err
+	}
+
+	manager := db.NewDatabaseManager()
+	manager.LoadConnections(ctx, cfg, environment, selection)
+
+	if len(manager.GetConnections()) == 0 {
+		manager.Close()
+		return nil, fmt.Errorf("%s", locale.L.Errors.NoConnectionsSelected)
+	}
+
+	return manager, nil
+}
+
 func startQueryingProcess(
 	ctx context.Context, cfg *config.Config, query string,
 	environment string, noCache bool, commit bool, command string,
 	connections []string,
-) (map[string]*db.ResultSet, map[string]error) {
-	manager := db.NewDatabaseManager()
-	manager.LoadConnections(ctx, cfg, environment, connections)
+) (map[string]*db.ResultSet, map[string]error, error) {
+	ctx, cancel := withRunTimeout(ctx)
+	defer cancel()
+
+	manager, err := loadConnections(ctx, environment, connections)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer manager.Close()
 
 	executor := db.NewExecutor(manager)
-	return executor.ParallelExecution(
+	defer reportInterruption(ctx, executor)
+
+	results, failures := executor.ParallelExecution(
 		ctx, cfg.MaxWorkers, query,
 		!noCache, commit, cfg, command,
-		connections,
 	)
+	return results, failures, nil
+}
+
+// Reports whether the command runs without the connections: help and the
+// config commands, which read or fix the connections file themselves.
+// add-connection only needs them when the file exists, to check the name
+func connectionsOptional(args cli.Args, err error) bool {
+	switch args.First() {
+	case "", "help":
+		return true
+	case "config":
+		return args.Get(1) != "add-connection" || errors.Is(err, fs.ErrNotExist)
+	}
+	return false
 }
 
-func Prismatic(cfg *config.Config) {
-	var environment string
-	var configFile string
+// Returns the exit error for a run with the given successful and failed connections
+func exitStatus(ctx context.Context, successful int, failures map[string]error) error {
+	if interrupted(ctx) {
+		return cli.Exit(locale.L.ExitMessages.Interrupted, ExitCodeInterrupted)
+	} else if len(failures) > 0 && successful == 0 {
+		return cli.Exit(locale.L.ExitMessages.FullFail, ExitCodeFullFailure)
+	} else if len(failures) > 0 {
+		return cli.Exit(locale.L.ExitMessages.PartialFail, ExitCodePartialFailure)
+	} else {
+		return cli.Exit(locale.L.ExitMessages.Success, ExitCodeSuccess)
+	}
+}
+
+func Prismatic(conf *config.Config) {
 	var outputFormat string
 	var noSingleSheet bool
 	var noSingleFile bool
-	var connections []string
-	var commit bool
 	var noCache bool
 
-	l, err := locale.Load(cfg.Locale)
-	if err != nil {
-		log.Fatal(err)
-	}
+	cfg = conf
+
+	l := locale.L
 
 	cmd := &cli.Command{
 		Name:        "prismatic",
@@ -88,10 +208,15 @@ func Prismatic(cfg *config.Config) {
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:        "config",
-				Value:       "./config/config.toml",
 				Usage:       l.CLI.Flags.Config,
 				Destination: &configFile,
 			},
+			&cli.StringFlag{
+				Name:        "profile",
+				Usage:       l.CLI.Flags.Profile,
+				Sources:     cli.EnvVars(config.ProfileEnv),
+				Destination: &cfg.Profile,
+			},
 			&cli.StringFlag{
 				Name:        "environment",
 				Aliases:     []string{"e"},
@@ -105,17 +230,48 @@ func Prismatic(cfg *config.Config) {
 				Usage:   l.CLI.Flags.Connections,
 				Destination: &connections,
 			},
+			&cli.DurationFlag{
+				Name:        "query-timeout",
+				Usage:       l.CLI.Flags.QueryTimeout,
+				Destination: &queryTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "run-timeout",
+				Usage:       l.CLI.Flags.RunTimeout,
+				Destination: &runTimeout,
+			},
 		},
 		Before: func(ctx context.Context, c *cli.Command) (context.Context, error) {
-			if _, ok := os.Stat(configFile); ok != nil {
-				return ctx, fmt.Errorf("err", configFile)
-			}
-			err := cfg.UpdateFromFile(configFile)
+			path, err := config.Discover(configFile)
 			if err != nil {
+				// The default configuration can be installed without one
+				if c.Args().First() == "config" && c.Args().Get(1) == "install" {
+					return ctx, nil
+				}
 				return ctx, err
 			}
+			if err := loadConfig(path); err != nil {
+				// config validate reports what keeps the file from loading
+				if c.Args().First() != "config" || c.Args().Get(1) != "validate" {
+					return ctx, err
+				}
+				cfg.Path = path
+				return ctx, nil
+			}
+			if c.IsSet("query-timeout") {
+				cfg.QueryTimeoutDuration = queryTimeout
+			}
+			if c.IsSet("run-timeout") {
+				cfg.RunTimeoutDuration = runTimeout
+			}
 
-			cfg.LoadConnections()
+			if cfg.Secrets.KeyFile != "" {
+				secrets.Register("enc", secrets.NewEncryptedProvider(cfg.Secrets.KeyFile))
+			}
+
+			if err := cfg.LoadConnections(); err != nil && !connectionsOptional(c.Args(), err) {
+				return ctx, err
+			}
 			return ctx, nil
 		},
 		Commands: []*cli.Command{
@@ -131,7 +287,7 @@ func Prismatic(cfg *config.Config) {
 					},
 				},
 				Usage: l.CLI.Commands.Export,
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:  "output-format",
 						Usage: l.CLI.Flags.OutputFormat,
@@ -145,7 +301,7 @@ func Prismatic(cfg *config.Config) {
 						Usage:       l.CLI.Flags.NoCache,
 						Destination: &noCache,
 					},
-				},
+				}, sessionFlags(l)...),
 				MutuallyExclusiveFlags: []cli.MutuallyExclusiveFlags{{
 					Flags: [][]cli.Flag{
 						{
@@ -171,6 +327,9 @@ func Prismatic(cfg *config.Config) {
 					if err != nil {
 						return err
 					}
+					if err := applySessionFlags(c); err != nil {
+						return err
+					}
 
 					output := c.StringArg("output")
 
@@ -187,7 +346,10 @@ func Prismatic(cfg *config.Config) {
 						}
 					}
 
-					data, _ := startQueryingProcess(ctx, cfg, query, environment, noCache, commit, c.Name, connections)
+					data, _, err := startQueryingProcess(ctx, cfg, query, environment, noCache, commit, c.Name, connections)
+					if err != nil {
+						return err
+					}
 					if len(data) == 0 {
 						return fmt.Errorf("%s", l.Errors.NoDataReturned)
 					}
@@ -213,78 +375,72 @@ func Prismatic(cfg *config.Config) {
 					},
 				},
 				ArgsUsage: l.CLI.Args.Run,
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.BoolFlag{
 						Name:        "commit",
 						Usage:       l.CLI.Flags.Commit,
 						Destination: &commit,
 					},
-				},
+					&cli.BoolFlag{
+						Name:  "read-only",
+						Usage: l.CLI.Flags.ReadOnly,
+					},
+					&cli.BoolFlag{
+						Name:  "no-lock",
+						Usage: l.CLI.Flags.NoLock,
+					},
+					&cli.StringFlag{
+						Name:  "lock-name",
+						Usage: l.CLI.Flags.LockName,
+					},
+				}, sessionFlags(l)...),
 				Action: func(ctx context.Context, c *cli.Command) error {
 					query := c.StringArg("query")
+					if c.Bool("read-only") {
+						cfg.Transaction.ReadOnly = true
+					}
+					if c.Bool("no-lock") {
+						cfg.Transaction.Lock = false
+					}
+					if c.IsSet("lock-name") {
+						cfg.Transaction.LockName = c.String("lock-name")
+					}
+					if err := applySessionFlags(c); err != nil {
+						return err
+					}
 
-					success, failures := startQueryingProcess(ctx, cfg, query, environment, noCache, commit, c.Name, connections)
-
-					if len(failures) > 0 && len(success) == 0 {
-						return cli.Exit(locale.L.ExitMessages.FullFail, ExitCodeFullFailure)
-					} else if len(failures) > 0 {
-						return cli.Exit(locale.L.ExitMessages.PartialFail, ExitCodePartialFailure)
-					} else {
-						return cli.Exit(locale.L.ExitMessages.Success, ExitCodeSuccess)
+					success, failures, err := startQueryingProcess(ctx, cfg, query, environment, noCache, commit, c.Name, connections)
+					if err != nil {
+						return err
 					}
+
+					return exitStatus(ctx, len(success), failures)
 				},
 			},
+			checkCommand(l),
+			migrateCommand(l),
 			{
 				Name:  "config",
 				Usage: l.CLI.Commands.Config,
 				Commands: []*cli.Command{
-					{
-						Name:  "install",
-						Usage: l.CLI.Commands.ConfigInstall,
-						Action: func(ctx context.Context, c *cli.Command) error {
-							cfg.Installer.Install()
-							if err != nil {
-								return err
-							}
-							return cli.Exit(locale.L.ExitMessages.ConfigInstall, ExitCodeSuccess)
-						},
-					},
-					{
-						Name:  "show",
-						Usage: l.CLI.Commands.ConfigShow,
-						Arguments: []cli.Argument{
-							&cli.StringArg{
-								Name: "key",
-							},
-						},
-						ArgsUsage: l.CLI.Args.ConfigShow,
-						Action: func(ctx context.Context, c *cli.Command) error {
-							key := c.StringArg("key")
-							cfg.Show(key)
-							return cli.Exit("", ExitCodeSuccess)
-						},
-					},
-					{
-						//TODO: Refactor into calling a web UI for cross-platform support
-						Name:  "edit",
-						Usage: l.CLI.Commands.ConfigEdit,
-						Action: func(ctx context.Context, c *cli.Command) error {
-							editor := os.Getenv("EDITOR")
-							cmd := exec.CommandContext(ctx, editor, "config/config.toml")
-							err := cmd.Run()
-							if err != nil {
-								return err
-							}
-
-							return cli.Exit("", ExitCodeSuccess)
-						},
-					},
+					configInstallCommand(l),
+					configShowCommand(l),
+					configSetCommand(l),
+					configEditCommand(l),
+					configEncryptCommand(l),
+					configDecryptCommand(l),
+					configValidateCommand(l),
+					configAddConnectionCommand(l),
+					configImportCommand(l),
 				},
 			},
 		},
 	}
 
-	if err := cmd.Run(context.Background(), os.Args); err != nil {
+	ctx, stop := withSignalHandling()
+	defer stop()
+
+	if err := cmd.Run(ctx, os.Args); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,333 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/locale"
+	"ohnitiel/prismatic/internal/logger"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Loads the configuration file and profile selected on the command line,
+// then the locale and the logger they set
+func loadConfig(path string) error {
+	reloaded, err := cfg.Reload(path)
+	if err != nil || !reloaded {
+		return err
+	}
+
+	l, err := cfg.LoadLocale()
+	if err != nil {
+		return err
+	}
+	locale.L = l
+	return logger.Setup(cfg.Logging)
+}
+
+func configInstallCommand(l *locale.Locale) *cli.Command {
+	var user bool
+
+	return &cli.Command{
+		Name:  "install",
+		Usage: l.CLI.Commands.ConfigInstall,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "user",
+				Usage:       l.CLI.Flags.User,
+				Destination: &user,
+			},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			dir := "config"
+			if user {
+				var err error
+				if dir, err = config.UserDir(); err != nil {
+					return err
+				}
+			}
+
+			if err := cfg.Installer.Install(dir); err != nil {
+				return err
+			}
+			return cli.Exit(fmt.Sprintf(locale.L.ExitMessages.ConfigInstall, dir), ExitCodeSuccess)
+		},
+	}
+}
+
+func configShowCommand(l *locale.Locale) *cli.Command {
+	var format string
+	var effective bool
+
+	return &cli.Command{
+		Name:  "show",
+		Usage: l.CLI.Commands.ConfigShow,
+		Arguments: []cli.Argument{
+			&cli.StringArg{
+				Name: "key",
+			},
+		},
+		ArgsUsage: l.CLI.Args.ConfigShow,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       l.CLI.Flags.Format,
+				Value:       config.FormatTOML,
+				Destination: &format,
+			},
+			&cli.BoolFlag{
+				Name:        "effective",
+				Usage:       l.CLI.Flags.Effective,
+				Destination: &effective,
+			},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			if effective {
+				if err := cfg.ShowEffective(os.Stdout, c.StringArg("key"), format); err != nil {
+					return err
+				}
+				return cli.Exit("", ExitCodeSuccess)
+			}
+			if err := cfg.Show(os.Stdout, c.StringArg("key"), format); err != nil {
+				return err
+			}
+			return cli.Exit("", ExitCodeSuccess)
+		},
+	}
+}
+
+func configSetCommand(l *locale.Locale) *cli.Command {
+	return &cli.Command{
+		Name:  "set",
+		Usage: l.CLI.Commands.ConfigSet,
+		Arguments: []cli.Argument{
+			&cli.StringArg{
+				Name: "key",
+			},
+			&cli.StringArg{
+				Name: "value",
+			},
+		},
+		ArgsUsage: l.CLI.Args.ConfigSet,
+		Action: func(ctx context.Context, c *cli.Command) error {
+			if c.StringArg("key") == "" {
+				return cli.ShowSubcommandHelp(c)
+			}
+			if err := cfg.Set(c.StringArg("key"), c.StringArg("value")); err != nil {
+				return err
+			}
+			return cli.Exit(locale.L.ExitMessages.ConfigSet, ExitCodeSuccess)
+		},
+	}
+}
+
+func configEditCommand(l *locale.Locale) *cli.Command {
+	return &cli.Command{
+		//TODO: Refactor into calling a web UI for cross-platform support
+		Name:  "edit",
+		Usage: l.CLI.Commands.ConfigEdit,
+		Arguments: []cli.Argument{
+			&cli.StringArg{
+				Name:  "file",
+				Value: "config",
+			},
+		},
+		ArgsUsage: l.CLI.Args.ConfigEdit,
+		Action: func(ctx context.Context, c *cli.Command) error {
+			var path string
+			switch c.StringArg("file") {
+			case "config":
+				path = cfg.Path
+			case "connections":
+				path = cfg.Paths.Connections
+			default:
+				return fmt.Errorf(locale.L.Errors.UnknownConfigFile, c.StringArg("file"))
+			}
+
+			editor := os.Getenv("EDITOR")
+			if editor == "" {
+				editor = "vi"
+			}
+			cmd := exec.CommandContext(ctx, editor, path)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				return err
+			}
+
+			return cli.Exit("", ExitCodeSuccess)
+		},
+	}
+}
+
+func configEncryptCommand(l *locale.Locale) *cli.Command {
+	var wholeFile bool
+	var keyFile string
+
+	return &cli.Command{
+		Name:  "encrypt",
+		Usage: l.CLI.Commands.ConfigEncrypt,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "whole-file",
+				Usage:       l.CLI.Flags.WholeFile,
+				Destination: &wholeFile,
+			},
+			&cli.StringFlag{
+				Name:        "key-file",
+				Usage:       l.CLI.Flags.KeyFile,
+				Destination: &keyFile,
+			},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			if keyFile != "" {
+				cfg.Secrets.KeyFile = keyFile
+			}
+			if err := cfg.EncryptConnectionsFile(wholeFile); err != nil {
+				return err
+			}
+			return cli.Exit(locale.L.ExitMessages.ConfigEncrypted, ExitCodeSuccess)
+		},
+	}
+}
+
+func configDecryptCommand(l *locale.Locale) *cli.Command {
+	var keyFile string
+
+	return &cli.Command{
+		Name:  "decrypt",
+		Usage: l.CLI.Commands.ConfigDecrypt,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "key-file",
+				Usage:       l.CLI.Flags.KeyFile,
+				Destination: &keyFile,
+			},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			if keyFile != "" {
+				cfg.Secrets.KeyFile = keyFile
+			}
+			if err := cfg.DecryptConnectionsFile(); err != nil {
+				return err
+			}
+			return cli.Exit(locale.L.ExitMessages.ConfigDecrypted, ExitCodeSuccess)
+		},
+	}
+}
+
+func configValidateCommand(l *locale.Locale) *cli.Command {
+	return &cli.Command{
+		Name:  "validate",
+		Usage: l.CLI.Commands.ConfigValidate,
+		Action: func(ctx context.Context, c *cli.Command) error {
+			diagnostics := config.Validate(cfg.Path)
+			for _, diagnostic := range diagnostics {
+				fmt.Println(diagnostic)
+			}
+
+			if len(diagnostics) > 0 {
+				return cli.Exit(locale.L.ExitMessages.ConfigInvalid, ExitCodeInvalidConfig)
+			}
+			return cli.Exit(locale.L.ExitMessages.ConfigValid, ExitCodeSuccess)
+		},
+	}
+}
+
+func configImportCommand(l *locale.Locale) *cli.Command {
+	var format string
+	var envMap []string
+	var dryRun bool
+	var secretStore string
+
+	return &cli.Command{
+		Name:  "import",
+		Usage: l.CLI.Commands.ConfigImport,
+		Arguments: []cli.Argument{
+			&cli.StringArg{
+				Name: "file",
+			},
+		},
+		ArgsUsage: l.CLI.Args.ConfigImport,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       l.CLI.Flags.ImportFormat,
+				Destination: &format,
+			},
+			&cli.StringSliceFlag{
+				Name:        "env-map",
+				Usage:       l.CLI.Flags.EnvMap,
+				Destination: &envMap,
+			},
+			&cli.BoolFlag{
+				Name:        "dry-run",
+				Usage:       l.CLI.Flags.DryRun,
+				Destination: &dryRun,
+			},
+			&cli.StringFlag{
+				Name:        "secret-store",
+				Usage:       l.CLI.Flags.SecretStore,
+				Value:       config.SecretStoreEnv,
+				Destination: &secretStore,
+			},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			path := c.StringArg("file")
+			if path == "" {
+				return cli.ShowSubcommandHelp(c)
+			}
+			if format == "" {
+				format = config.ImportFormat(path)
+			}
+
+			suffixes := make(map[string]string, len(envMap))
+			for _, mapping := range envMap {
+				suffix, envName, ok := strings.Cut(mapping, "=")
+				if !ok || suffix == "" || envName == "" {
+					return fmt.Errorf(locale.L.Errors.InvalidEnvMap, mapping)
+				}
+				suffixes[suffix] = envName
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			connections, err := config.ImportConnections(f, format, environment, suffixes)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if secretStore != config.SecretStoreEnv && secretStore != config.SecretStoreEnc {
+				return fmt.Errorf(locale.L.Errors.UnknownSecretStore, secretStore)
+			}
+			if err := cfg.StorePasswords(connections, secretStore, !dryRun); err != nil {
+				return err
+			}
+
+			if dryRun {
+				names := slices.Sorted(maps.Keys(connections))
+				for i, name := range names {
+					if i > 0 {
+						fmt.Println()
+					}
+					fmt.Print(config.FormatConnection(name, connections[name]))
+				}
+				return cli.Exit("", ExitCodeSuccess)
+			}
+
+			if err := cfg.AppendConnections(connections); err != nil {
+				return err
+			}
+			return cli.Exit(fmt.Sprintf(locale.L.ExitMessages.ConnectionsImported, len(connections)), ExitCodeSuccess)
+		},
+	}
+}
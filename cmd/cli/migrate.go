@@ -0,0 +1,168 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"ohnitiel/prismatic/internal/db"
+	"ohnitiel/prismatic/internal/locale"
+	"ohnitiel/prismatic/internal/migrate"
+
+	"github.com/urfave/cli/v3"
+)
+
+const defaultMigrationsDir = "./migrations"
+
+// Loads the migrations and connections, returning a ready runner, the
+// context bounded by the run timeout and a function to release both
+func newMigrationRunner(
+	ctx context.Context, dir string,
+) (*migrate.Runner, []*migrate.Migration, context.Context, func(), error) {
+	if dir == "" {
+		dir = defaultMigrationsDir
+	}
+
+	migrations, err := migrate.Load(dir)
+	if err != nil {
+		return nil, nil, ctx, nil, err
+	}
+
+	ctx, cancel := withRunTimeout(ctx)
+
+	manager, err := loadConnections(ctx, environment, connections)
+	if err != nil {
+		cancel()
+		return nil, nil, ctx, nil, err
+	}
+
+	executor := db.NewExecutor(manager)
+	runner := migrate.NewRunner(executor, cfg, migrations)
+
+	release := func() {
+		reportInterruption(ctx, executor)
+		manager.Close()
+		cancel()
+	}
+
+	return runner, migrations, ctx, release, nil
+}
+
+// Prints the versions touched on each connection and the run summary.
+// Returns the number of successful connections
+func printMigrationResult(done map[string][]uint64, failures map[string]error) int {
+	names := make([]string, 0, len(done))
+	for name := range done {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(done[name]) > 0 {
+			fmt.Printf("%s: %v\n", name, done[name])
+		}
+	}
+
+	successful := 0
+	for name := range done {
+		if _, failed := failures[name]; !failed {
+			successful++
+		}
+	}
+
+	fmt.Println(db.NewSummary(successful, failures))
+
+	return successful
+}
+
+func migrateCommand(l *locale.Locale) *cli.Command {
+	var steps int
+
+	dirArg := []cli.Argument{
+		&cli.StringArg{
+			Name:  "directory",
+			Value: defaultMigrationsDir,
+		},
+	}
+	commitFlag := &cli.BoolFlag{
+		Name:        "commit",
+		Usage:       l.CLI.Flags.Commit,
+		Destination: &commit,
+	}
+
+	return &cli.Command{
+		Name:  "migrate",
+		Usage: l.CLI.Commands.Migrate,
+		Commands: []*cli.Command{
+			{
+				Name:      "up",
+				Usage:     l.CLI.Commands.MigrateUp,
+				ArgsUsage: l.CLI.Args.Migrate,
+				Arguments: dirArg,
+				Flags:     []cli.Flag{commitFlag},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					runner, _, ctx, release, err := newMigrationRunner(ctx, c.StringArg("directory"))
+					if err != nil {
+						return err
+					}
+					defer release()
+
+					applied, failures := runner.Up(ctx, commit)
+					successful := printMigrationResult(applied, failures)
+
+					return exitStatus(ctx, successful, failures)
+				},
+			},
+			{
+				Name:      "down",
+				Usage:     l.CLI.Commands.MigrateDown,
+				ArgsUsage: l.CLI.Args.Migrate,
+				Arguments: dirArg,
+				Flags: []cli.Flag{
+					commitFlag,
+					&cli.IntFlag{
+						Name:        "steps",
+						Usage:       l.CLI.Flags.Steps,
+						Value:       1,
+						Destination: &steps,
+					},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					if steps < 1 {
+						return fmt.Errorf(l.Errors.InvalidSteps, steps)
+					}
+
+					runner, _, ctx, release, err := newMigrationRunner(ctx, c.StringArg("directory"))
+					if err != nil {
+						return err
+					}
+					defer release()
+
+					reverted, failures := runner.Down(ctx, commit, steps)
+					successful := printMigrationResult(reverted, failures)
+
+					return exitStatus(ctx, successful, failures)
+				},
+			},
+			{
+				Name:      "status",
+				Usage:     l.CLI.Commands.MigrateStatus,
+				ArgsUsage: l.CLI.Args.Migrate,
+				Arguments: dirArg,
+				Action: func(ctx context.Context, c *cli.Command) error {
+					runner, migrations, ctx, release, err := newMigrationRunner(ctx, c.StringArg("directory"))
+					if err != nil {
+						return err
+					}
+					defer release()
+
+					status, failures := runner.Status(ctx)
+					migrate.PrintStatus(os.Stdout, migrations, status, failures)
+
+					return exitStatus(ctx, len(status), failures)
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/locale"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Flags setting the isolation, lock timeout and parameters of the
+// transactions of a run, over the ones of each connection
+func sessionFlags(l *locale.Locale) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "isolation",
+			Usage: l.CLI.Flags.Isolation,
+		},
+		&cli.DurationFlag{
+			Name:  "lock-timeout",
+			Usage: l.CLI.Flags.LockTimeout,
+		},
+		&cli.GenericFlag{
+			Name:  "set",
+			Usage: l.CLI.Flags.Set,
+			Value: &settings{},
+		},
+	}
+}
+
+// Values of a repeatable flag, kept whole. Slice flags would split them on
+// commas, which setting values such as search_path contain
+type settings []string
+
+func (s *settings) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func (s *settings) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *settings) Get() any {
+	return []string(*s)
+}
+
+// Stores the session flags given to the command in the configuration
+func applySessionFlags(c *cli.Command) error {
+	if isolation := c.String("isolation"); isolation != "" {
+		if !config.IsIsolationLevel(isolation) {
+			return fmt.Errorf(locale.L.Errors.InvalidIsolation,
+				isolation, strings.Join(config.IsolationLevels, ", "))
+		}
+		cfg.Session.Isolation = isolation
+	}
+	if c.IsSet("lock-timeout") {
+		cfg.Session.LockTimeout = uint32(c.Duration("lock-timeout").Milliseconds())
+		cfg.Session.LockTimeoutSet = true
+	}
+
+	values, _ := c.Value("set").([]string)
+	for _, setting := range values {
+		name, value, ok := strings.Cut(setting, "=")
+		if !ok || name == "" {
+			return fmt.Errorf(locale.L.Errors.InvalidSetting, setting)
+		}
+		if cfg.Session.Settings == nil {
+			cfg.Session.Settings = make(map[string]string)
+		}
+		cfg.Session.Settings[name] = value
+	}
+	return nil
+}
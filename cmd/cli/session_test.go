@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/locale"
+
+	"github.com/urfave/cli/v3"
+)
+
+func TestSessionFlags(t *testing.T) {
+	locale.L = &locale.Locale{}
+	cfg = config.NewConfig()
+
+	cmd := &cli.Command{
+		Name:  "run",
+		Flags: sessionFlags(locale.L),
+		Action: func(ctx context.Context, c *cli.Command) error {
+			return applySessionFlags(c)
+		},
+	}
+	args := []string{"run", "--set", "search_path=public,audit", "--set", "work_mem=64MB", "--lock-timeout", "0"}
+	if err := cmd.Run(context.Background(), args); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	want := map[string]string{"search_path": "public,audit", "work_mem": "64MB"}
+	if !maps.Equal(cfg.Session.Settings, want) {
+		t.Errorf("Session.Settings = %v, want %v", cfg.Session.Settings, want)
+	}
+	if !cfg.Session.LockTimeoutSet || cfg.Session.LockTimeout != 0 {
+		t.Errorf("Session = %+v, want the lock timeout set to 0", cfg.Session)
+	}
+}
@@ -0,0 +1,275 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/db"
+	"ohnitiel/prismatic/internal/locale"
+	"ohnitiel/prismatic/internal/secrets"
+
+	"github.com/urfave/cli/v3"
+	"golang.org/x/term"
+)
+
+const defaultPostgresPort = 5432
+
+// Time given to each environment to answer the connection test
+const connectionTestTimeout = 15 * time.Second
+
+// Reads the answers of the add-connection wizard
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// Asks for a value, returning def when the answer is empty. A last answer
+// without a newline is accepted, the next question failing with io.EOF
+func (p *prompter) ask(label string, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", label, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", label)
+	}
+
+	answer, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || answer == "") {
+		return "", err
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// Asks until a non-empty answer accepted by valid is given
+func (p *prompter) require(label string, def string, valid func(string) bool) (string, error) {
+	for {
+		answer, err := p.ask(label, def)
+		switch {
+		case err != nil:
+			return "", err
+		case answer == "":
+			fmt.Fprintln(p.out, locale.L.CLI.Prompts.Required)
+		case valid != nil && !valid(answer):
+			fmt.Fprintf(p.out, locale.L.CLI.Prompts.Invalid+"\n", answer)
+		default:
+			return answer, nil
+		}
+	}
+}
+
+// Asks for a secret without echoing it when reading from a terminal
+func (p *prompter) secret(label string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return p.ask(label, "")
+	}
+
+	fmt.Fprintf(p.out, "%s: ", label)
+	answer, err := term.ReadPassword(fd)
+	fmt.Fprintln(p.out)
+	return strings.TrimSpace(string(answer)), err
+}
+
+// Reports whether the answer is yes, in any of the locales
+func yes(answer string) bool {
+	answer = strings.ToLower(answer)
+	return strings.HasPrefix(answer, "y") || strings.HasPrefix(answer, "s")
+}
+
+func configAddConnectionCommand(l *locale.Locale) *cli.Command {
+	return &cli.Command{
+		Name:  "add-connection",
+		Usage: l.CLI.Commands.ConfigAddConnection,
+		Action: func(ctx context.Context, c *cli.Command) error {
+			p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+
+			// The input ended before every question was answered
+			err := addConnection(ctx, p)
+			if errors.Is(err, io.EOF) {
+				fmt.Fprintln(p.out)
+				return cli.Exit(locale.L.ExitMessages.NothingAdded, ExitCodeFullFailure)
+			}
+			return err
+		},
+	}
+}
+
+// Asks for the new connection, tests it and appends it to the connections
+// file
+func addConnection(ctx context.Context, p *prompter) error {
+	prompts := locale.L.CLI.Prompts
+
+	name, err := p.require(prompts.Name, "", func(name string) bool {
+		_, exists := cfg.Connections[name]
+		return !exists
+	})
+	if err != nil {
+		return err
+	}
+	engine, err := p.require(prompts.Engine, "postgresql", func(engine string) bool {
+		return slices.Contains(config.SupportedEngines, engine)
+	})
+	if err != nil {
+		return err
+	}
+	conn := &config.Connection{Engine: engine, Environment: make(map[string]*config.Environment)}
+	if conn.IsFile() {
+		return addFileConnection(ctx, p, name, conn)
+	}
+
+	if conn.Database, err = p.ask(prompts.Database, ""); err != nil {
+		return err
+	}
+	if conn.Username, err = p.ask(prompts.Username, ""); err != nil {
+		return err
+	}
+	password, err := p.secret(prompts.Password)
+	if err != nil {
+		return err
+	}
+	if conn.SSLMode, err = p.ask(prompts.SSLMode, ""); err != nil {
+		return err
+	}
+
+	envNames, err := p.require(prompts.Environments, environment, nil)
+	if err != nil {
+		return err
+	}
+	for _, envName := range strings.Split(envNames, ",") {
+		envName = strings.TrimSpace(envName)
+		if envName == "" {
+			continue
+		}
+
+		host, err := p.require(fmt.Sprintf(prompts.Host, envName), "", nil)
+		if err != nil {
+			return err
+		}
+		port, err := p.require(fmt.Sprintf(prompts.Port, envName), strconv.Itoa(defaultPostgresPort), func(port string) bool {
+			_, err := strconv.ParseUint(port, 10, 16)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+
+		env := &config.Environment{Host: host}
+		if number, _ := strconv.ParseUint(port, 10, 16); number != defaultPostgresPort {
+			env.Port = uint16(number)
+		}
+		conn.Environment[envName] = env
+	}
+
+	conn.Password = password
+	if err := confirmNewConnection(ctx, p, name, conn); err != nil {
+		return err
+	}
+
+	stored, err := storePassword(p, name, password)
+	if err != nil {
+		return err
+	}
+	conn.Password = stored
+
+	if err := cfg.AppendConnections(map[string]*config.Connection{name: conn}); err != nil {
+		return err
+	}
+	return cli.Exit(locale.L.ExitMessages.ConnectionAdded, ExitCodeSuccess)
+}
+
+// Asks for the database file of each environment of a file connection
+func addFileConnection(ctx context.Context, p *prompter, name string, conn *config.Connection) error {
+	prompts := locale.L.CLI.Prompts
+
+	envNames, err := p.require(prompts.Environments, environment, nil)
+	if err != nil {
+		return err
+	}
+	for _, envName := range strings.Split(envNames, ",") {
+		if envName = strings.TrimSpace(envName); envName != "" {
+			database, err := p.require(fmt.Sprintf(prompts.File, envName), "", nil)
+			if err != nil {
+				return err
+			}
+			conn.Environment[envName] = &config.Environment{Database: database}
+		}
+	}
+
+	if err := confirmNewConnection(ctx, p, name, conn); err != nil {
+		return err
+	}
+	if err := cfg.AppendConnections(map[string]*config.Connection{name: conn}); err != nil {
+		return err
+	}
+	return cli.Exit(locale.L.ExitMessages.ConnectionAdded, ExitCodeSuccess)
+}
+
+// Tests the new connection, asking whether to save it anyway when an
+// environment can't be reached
+func confirmNewConnection(ctx context.Context, p *prompter, name string, conn *config.Connection) error {
+	if testNewConnection(ctx, p, name, conn) {
+		return nil
+	}
+	answer, err := p.ask(locale.L.CLI.Prompts.SaveAnyway, "")
+	if err != nil {
+		return err
+	}
+	if !yes(answer) {
+		return cli.Exit(locale.L.ExitMessages.NothingAdded, ExitCodeFullFailure)
+	}
+	return nil
+}
+
+// Tests the new connection on each of its environments, reporting the
+// result of each. Returns true when every environment was reached
+func testNewConnection(ctx context.Context, p *prompter, name string, conn *config.Connection) bool {
+	manager := db.NewDatabaseManager()
+	defer manager.Close()
+
+	reached := true
+	for envName, env := range conn.Environment {
+		resolved := *env
+		conn.Resolve(&resolved)
+
+		testCtx, cancel := context.WithTimeout(ctx, connectionTestTimeout)
+		err := manager.Test(testCtx, cfg, name, conn, &resolved)
+		cancel()
+
+		if err != nil {
+			fmt.Fprintf(p.out, locale.L.CLI.Prompts.ConnectionError+"\n", envName, err)
+			reached = false
+		} else {
+			fmt.Fprintf(p.out, locale.L.CLI.Prompts.ConnectionOK+"\n", envName)
+		}
+	}
+
+	return reached
+}
+
+// Stores a plaintext password in the .env file or encrypted, as chosen,
+// returning the value to write in the connections file. Secret references
+// are kept as is
+func storePassword(p *prompter, name string, password string) (string, error) {
+	if password == "" || secrets.IsReference(password) {
+		return password, nil
+	}
+
+	store, err := p.require(locale.L.CLI.Prompts.SecretStore, config.SecretStoreEnv, func(store string) bool {
+		return store == config.SecretStoreEnv || store == config.SecretStoreEnc
+	})
+	if err != nil {
+		return "", err
+	}
+	return cfg.StorePassword(config.PasswordVariable(name), password, store)
+}
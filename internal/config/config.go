@@ -2,12 +2,14 @@ package config
 
 import (
 	"embed"
+	"errors"
 	"fmt"
-	"log"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
+	"path/filepath"
 	"slices"
-	"strings"
 	"time"
 
 	"ohnitiel/prismatic/internal/locale"
@@ -17,23 +19,72 @@ import (
 )
 
 type Environment struct {
-	Host     string `toml:"host"`
-	Port     uint16 `toml:"port"`
-	Username string `toml:"username"`
-	Password string `toml:"password"`
-	Database string `toml:"database"`
+	Host     string     `toml:"host"`
+	Port     uint16     `toml:"port"`
+	Username string     `toml:"username"`
+	Password string     `toml:"password"`
+	Database string     `toml:"database"`
+	Service  string     `toml:"service"`
+	SSH      *SSHConfig `toml:"ssh"` // Replaces the connection tunnel
+	TLSConfig
+	SessionConfig
 	Disabled bool
 }
 
 type Connection struct {
-	Engine      string `toml:"engine"`
-	Host        string `toml:"host"`
-	Port        uint16 `toml:"port"`
-	Database    string `toml:"database"`
-	Username    string `toml:"username"`
-	Password    string `toml:"password"`
-	SSLMode     string `toml:"sslmode"`
-	Environment map[string]*Environment
+	Engine       string      `toml:"engine"`
+	Host         string      `toml:"host"`
+	Port         uint16      `toml:"port"`
+	Database     string      `toml:"database"`
+	Username     string      `toml:"username"`
+	Password     string      `toml:"password"`
+	Service      string      `toml:"service"`       // Entry of pg_service.conf (PGSERVICEFILE)
+	PassFile     string      `toml:"passfile"`      // Defaults to PGPASSFILE or ~/.pgpass
+	QueryTimeout uint16      `toml:"query_timeout"` // Overrides the global query timeout, in seconds
+	Pool         *PoolConfig `toml:"pool"`          // Overrides the global pool settings
+	Group        string      `toml:"group"`         // Shares the concurrency limit of the group
+	Tags         []string    `toml:"tags"`
+	SSH          *SSHConfig  `toml:"ssh"` // Tunnel used to reach the host
+	TLSConfig
+	SessionConfig
+	// Expands the entry into one connection per database matching the
+	// pattern, or returned by the query, on the server
+	Discover      string `toml:"discover"`
+	DiscoverQuery string `toml:"discover_query"`
+	Environment   map[string]*Environment
+}
+
+// TLS settings, following the libpq parameters of the same name.
+// The environment settings override the connection ones
+type TLSConfig struct {
+	SSLMode       string `toml:"sslmode"`
+	SSLRootCert   string `toml:"sslrootcert"`
+	SSLCert       string `toml:"sslcert"`
+	SSLKey        string `toml:"sslkey"`
+	SSLPassword   string `toml:"sslpassword"`   // May be a secret reference
+	SSLServerName string `toml:"sslservername"` // Name verified against the server certificate, defaults to the host
+}
+
+// Settings of the transactions opened on a connection, overridden by the
+// --isolation, --lock-timeout and --set flags. The environment settings
+// override the connection ones
+type SessionConfig struct {
+	Isolation   string            `toml:"isolation"`    // e.g. "repeatable read", empty keeps the server default
+	LockTimeout uint32            `toml:"lock_timeout"` // Described in milliseconds
+	Settings    map[string]string `toml:"settings"`     // Parameters set for the transaction, e.g. search_path
+	// Set by --lock-timeout, so an explicit 0 turns the lock timeout off
+	LockTimeoutSet bool `toml:"-"`
+}
+
+// SSH tunnel through a bastion host. Databases behind the same bastion
+// share one tunnel
+type SSHConfig struct {
+	Host       string   `toml:"host"`
+	Port       uint16   `toml:"port"` // Defaults to 22
+	User       string   `toml:"user"`
+	KeyFile    string   `toml:"key_file"`    // Defaults to the agent at SSH_AUTH_SOCK
+	KnownHosts string   `toml:"known_hosts"` // Defaults to ~/.ssh/known_hosts
+	Jump       []string `toml:"jump"`        // Hosts to go through first, as user@host:port
 }
 
 type LoggerConfigs struct {
@@ -47,6 +98,47 @@ type PathConfigs struct {
 	Connections string `toml:"connections"`
 }
 
+type SecretsConfig struct {
+	// Key file used for encrypted connections, PRISMATIC_PASSPHRASE takes
+	// precedence over it
+	KeyFile string `toml:"key_file"`
+}
+
+// Connection pool limits. Zero values keep the database/sql defaults
+type PoolConfig struct {
+	MaxOpen     uint16 `toml:"max_open"`
+	MaxIdle     uint16 `toml:"max_idle"`
+	MaxLifetime uint16 `toml:"max_lifetime"`  // Described in seconds
+	MaxIdleTime uint16 `toml:"max_idle_time"` // Described in seconds
+}
+
+// Concurrency limits applied on top of max_workers.
+// Zero values mean no limit
+type ConcurrencyConfig struct {
+	PerHost uint8            `toml:"per_host"`
+	Hosts   map[string]uint8 `toml:"hosts"`  // Overrides per_host for specific hosts
+	Groups  map[string]uint8 `toml:"groups"` // Limits for connections sharing a group
+}
+
+// Retry policy for query execution
+type RetryConfig struct {
+	MaxAttempts    uint8    `toml:"max_attempts"`
+	InitialBackoff uint32   `toml:"initial_backoff"` // Described in milliseconds
+	MaxBackoff     uint32   `toml:"max_backoff"`     // Described in milliseconds
+	Budget         uint16   `toml:"budget"`          // Described in seconds
+	Retryable      []string `toml:"retryable"`       // SQLSTATE codes or classes
+}
+
+// Settings of the transactions opened by a run
+type TransactionConfig struct {
+	ReadOnly      bool   `toml:"read_only"`      // Opens every transaction read-only, like run --read-only
+	ReadIsolation string `toml:"read_isolation"` // Isolation level of read-only transactions
+	// Takes an advisory lock before committed writes, so concurrent runs of
+	// the same query, or with the same lock name, skip the busy connections
+	Lock     bool   `toml:"lock"`
+	LockName string `toml:"lock_name"` // Defaults to the query
+}
+
 type CacheConfig struct {
 	UseCache   bool   `toml:"use_cache"`
 	TimeToLive uint16 `toml:"time_to_live"`
@@ -54,68 +146,149 @@ type CacheConfig struct {
 }
 
 type Config struct {
-	Cache                CacheConfig            `toml:"cache"`
-	Locale               string                 `toml:"locale"`
-	MaxWorkers           uint8                  `toml:"max_workers"`
-	MaxRetries           uint8                  `toml:"max_retries"`
-	MaxConnections       uint8                  `toml:"max_connections"`
-	Timeout              uint8                  `toml:"timeout"`
-	Paths                PathConfigs            `toml:"paths"`
-	Connections          map[string]*Connection `toml:"connections"`
-	Logging              LoggerConfigs          `toml:"logger"`
-	ConnectionColumnName string                 `toml:"connection_column_name"`
+	Cache                CacheConfig               `toml:"cache"`
+	Locale               string                    `toml:"locale"`
+	MaxWorkers           uint8                     `toml:"max_workers"`
+	MaxRetries           uint8                     `toml:"max_retries"`
+	MaxConnections       uint8                     `toml:"max_connections"`
+	Timeout              uint8                     `toml:"timeout"`
+	QueryTimeout         uint16                    `toml:"query_timeout"`
+	RunTimeout           uint16                    `toml:"run_timeout"`
+	Pool                 PoolConfig                `toml:"pool"`
+	Concurrency          ConcurrencyConfig         `toml:"concurrency"`
+	Retry                RetryConfig               `toml:"retry"`
+	Transaction          TransactionConfig         `toml:"transaction"`
+	Paths                PathConfigs               `toml:"paths"`
+	Secrets              SecretsConfig             `toml:"secrets"`
+	Connections          map[string]*Connection    `toml:"connections"`
+	Logging              LoggerConfigs             `toml:"logger"`
+	ConnectionColumnName string                    `toml:"connection_column_name"`
+	Selections           map[string][]string       `toml:"selections"`
+	Profiles             map[string]map[string]any `toml:"profile"`
 	Installer            *Installer
+
+	// File the configuration was loaded from
+	Path string `toml:"-"`
+	// Profile merged over the file, selected by --profile
+	Profile string `toml:"-"`
+	// Profile actually merged by the last load
+	loadedProfile string
+	// Source of each key set by the file, the profile or the environment
+	sources map[string]string
+
+	// Session settings given by flags, overriding the connection ones
+	Session SessionConfig `toml:"-"`
+
+	// Resolved from QueryTimeout and RunTimeout, may be overridden by flags
+	QueryTimeoutDuration time.Duration
+	RunTimeoutDuration   time.Duration
 }
 
 func NewConfig() *Config {
-	return &Config{}
+	return &Config{Transaction: TransactionConfig{Lock: true}}
 }
 
 func FromFile(path string) (*Config, error) {
 	conf := NewConfig()
-
-	_, err := toml.DecodeFile(path, conf)
-	if err != nil {
-		return nil, fmt.Errorf("Error loading config TOML: %w", err)
+	if err := conf.UpdateFromFile(path); err != nil {
+		return nil, err
 	}
-	conf.Cache.MaxAge = time.Duration(conf.Cache.TimeToLive) * time.Second
 
 	return conf, nil
 }
 
-func (c *Config) Show(key string) {
-	switch v := strings.ToLower(key); v {
-		case "connections":	
-			fmt.Printf("Connections: %v\n", c.Connections)
-		case "locale":
-			fmt.Printf("Locale: %v\n", c.Locale)
-		case "max_workers":
-			fmt.Printf("Max workers: %v\n", c.MaxWorkers)
-		case "max_retries":
-			fmt.Printf("Max retries: %v\n", c.MaxRetries)
-		case "max_connections":
-			fmt.Printf("Max connections: %v\n", c.MaxConnections)
-		case "timeout":
-			fmt.Printf("Timeout: %v\n", c.Timeout)
-		case "paths":
-			fmt.Printf("Paths: %v\n", c.Paths)
-		case "logger":
-			fmt.Printf("Logger: %v\n", c.Logging)
-		case "connection_column_name":
-			fmt.Printf("Connection column name: %v\n", c.ConnectionColumnName)
-		default:
-			fmt.Printf("Unknown key: %v\n", key)
+// Loads path again for the selected profile. Unless both the file and the
+// profile are the ones already loaded, it starts over from the defaults, so
+// nothing set by the previous file or profile is kept. Returns whether it
+// started over
+func (c *Config) Reload(path string) (bool, error) {
+	if path == c.Path && c.Profile == c.loadedProfile {
+		return false, c.UpdateFromFile(path)
 	}
+
+	installer, profile := c.Installer, c.Profile
+	*c = *NewConfig()
+	c.Installer, c.Profile = installer, profile
+	return true, c.UpdateFromFile(path)
+}
+
+// Converts the values described in seconds to durations
+func (c *Config) resolveDurations() {
+	c.Cache.MaxAge = time.Duration(c.Cache.TimeToLive) * time.Second
+	c.QueryTimeoutDuration = time.Duration(c.QueryTimeout) * time.Second
+	c.RunTimeoutDuration = time.Duration(c.RunTimeout) * time.Second
 }
 
+// Decodes the file over the configuration, then merges the selected profile
+// and the PRISMATIC_* environment variables over it
 func (c *Config) UpdateFromFile(path string) error {
-	_, err := toml.DecodeFile(path, c)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error loading config TOML: %w", err)
+	}
+	meta, err := toml.Decode(string(data), c)
 	if err != nil {
 		return fmt.Errorf("Error loading config TOML: %w", err)
 	}
+	c.Path = path
+	c.loadedProfile = c.Profile
+
+	lines := keyLines(data)
+	c.trackSources(meta, lines)
+	if c.Profile != "" {
+		if err := c.applyProfile(lines); err != nil {
+			return err
+		}
+	}
+
+	c.resolvePaths()
+	if err := c.ApplyEnv(); err != nil {
+		return err
+	}
+	c.resolveDurations()
 	return nil
 }
 
+// Returns the pool settings of a connection, where every value set on the
+// connection overrides the global one
+func (c *Config) PoolFor(conn *Connection) PoolConfig {
+	pool := c.Pool
+	if conn.Pool == nil {
+		return pool
+	}
+
+	if conn.Pool.MaxOpen > 0 {
+		pool.MaxOpen = conn.Pool.MaxOpen
+	}
+	if conn.Pool.MaxIdle > 0 {
+		pool.MaxIdle = conn.Pool.MaxIdle
+	}
+	if conn.Pool.MaxLifetime > 0 {
+		pool.MaxLifetime = conn.Pool.MaxLifetime
+	}
+	if conn.Pool.MaxIdleTime > 0 {
+		pool.MaxIdleTime = conn.Pool.MaxIdleTime
+	}
+
+	return pool
+}
+
+// Returns the concurrency limit of a host
+func (c *Config) HostLimit(host string) uint8 {
+	if limit, ok := c.Concurrency.Hosts[host]; ok {
+		return limit
+	}
+	return c.Concurrency.PerHost
+}
+
+// Returns the concurrency limit of a group
+func (c *Config) GroupLimit(group string) uint8 {
+	if group == "" {
+		return 0
+	}
+	return c.Concurrency.Groups[group]
+}
+
 func (c *Config) GetConnection(name string) *Connection {
 	return c.Connections[name]
 }
@@ -140,14 +313,18 @@ func (c *Config) validateLoggerConfig() error {
 	consoleOutputs := []string{"stderr", "stdout"}
 
 	if !slices.Contains(consoleOutputs, c.Logging.ConsoleOutput) {
-		return fmt.Errorf("%s is not in valid console outputs [%v]!", c.Logging.ConsoleOutput, consoleOutputs)
+		return fmt.Errorf(locale.L.Errors.InvalidConsoleOutput, c.Logging.ConsoleOutput, consoleOutputs)
 	}
 
 	return nil
 }
 
 func (c *Connection) Resolve(env *Environment) {
-	if env.Host == "" {
+	if env.Service == "" {
+		env.Service = c.Service
+	}
+	// A service may provide the host
+	if env.Host == "" && env.Service == "" && !c.IsFile() {
 		slog.Warn(locale.L.Logs.NoHostSpecified)
 		env.Disabled = true
 		return
@@ -161,29 +338,100 @@ func (c *Connection) Resolve(env *Environment) {
 	if env.Username == "" {
 		env.Username = c.Username
 	}
+	// Passwords are kept as written, secret references are only resolved
+	// when the connection is opened
 	if env.Password == "" {
 		env.Password = c.Password
-	} else {
-		env.Password = getPasswordFromEnv(env)
 	}
+	if env.SSH == nil {
+		env.SSH = c.SSH
+	}
+	env.TLSConfig.inherit(c.TLSConfig)
+	env.SessionConfig = env.SessionConfig.Over(c.SessionConfig)
+}
+
+// Returns the settings of s filled with the ones of base it leaves empty.
+// Parameters set by both keep the value of s. A zero lock timeout counts as
+// empty unless LockTimeoutSet
+func (s SessionConfig) Over(base SessionConfig) SessionConfig {
+	if s.Isolation == "" {
+		s.Isolation = base.Isolation
+	}
+	if s.LockTimeout == 0 && !s.LockTimeoutSet {
+		s.LockTimeout, s.LockTimeoutSet = base.LockTimeout, base.LockTimeoutSet
+	}
+	if len(base.Settings) > 0 {
+		settings := maps.Clone(base.Settings)
+		maps.Copy(settings, s.Settings)
+		s.Settings = settings
+	}
+	return s
+}
+
+// Fills the empty settings with the ones of base
+func (t *TLSConfig) inherit(base TLSConfig) {
+	for _, setting := range []struct{ value, base *string }{
+		{&t.SSLMode, &base.SSLMode},
+		{&t.SSLRootCert, &base.SSLRootCert},
+		{&t.SSLCert, &base.SSLCert},
+		{&t.SSLKey, &base.SSLKey},
+		{&t.SSLPassword, &base.SSLPassword},
+		{&t.SSLServerName, &base.SSLServerName},
+	} {
+		if *setting.value == "" {
+			*setting.value = *setting.base
+		}
+	}
+}
+
+// Reports whether the connection's database is a local file
+func (c *Connection) IsFile() bool {
+	return slices.Contains(FileEngines, c.Engine)
+}
+
+// Reports whether the connection is a discovery entry
+func (c *Connection) IsDiscovery() bool {
+	return c.Discover != "" || c.DiscoverQuery != ""
+}
+
+// Returns copies of the connection and environment targeting the given
+// database, used for the connections found by discovery
+func (c *Connection) ForDatabase(env *Environment, database string) (*Connection, *Environment) {
+	conn := *c
+	conn.Database = database
+	conn.Discover = ""
+	conn.DiscoverQuery = ""
+
+	databaseEnv := *env
+	databaseEnv.Database = database
+
+	return &conn, &databaseEnv
 }
 
 func (c *Config) LoadConnections() error {
 	var connections map[string]*Connection
 
-	err := godotenv.Load()
-	if err != nil {
+	err := godotenv.Load(c.EnvFile())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return fmt.Errorf("Error loading .env file: %w", err)
 	}
 
-	_, err = toml.DecodeFile(c.Paths.Connections, &connections)
+	data, err := c.ReadConnectionsFile()
 	if err != nil {
-		return fmt.Errorf("Error loading connections TOML: %w", err)
+		return err
 	}
 
-	for _, conn := range connections {
-		conn.Password = getPasswordFromEnv(conn)
+	_, err = toml.Decode(string(data), &connections)
+	if err != nil {
+		return fmt.Errorf("Error loading connections TOML: %w", err)
+	}
 
+	for name, conn := range connections {
+		if err := conn.Interpolate(); err != nil {
+			slog.Warn(locale.L.Logs.UnresolvedConnection, "connection", name, "error", err)
+			delete(connections, name)
+			continue
+		}
 		for _, env := range conn.Environment {
 			conn.Resolve(env)
 		}
@@ -194,25 +442,6 @@ func (c *Config) LoadConnections() error {
 	return nil
 }
 
-func getPasswordFromEnv(info any) string {
-	var password string
-
-	switch v := info.(type) {
-	case *Environment:
-		password = v.Password
-	case *Connection:
-		password = v.Password
-	default:
-		return ""
-	}
-
-	if strings.HasPrefix(password, "${") && strings.HasSuffix(password, "}") {
-		envVar := strings.TrimPrefix(strings.TrimSuffix(password, "}"), "${")
-		return os.Getenv(envVar)
-	}
-	return password
-}
-
 type Installer struct {
 	installPath embed.FS
 }
@@ -221,31 +450,43 @@ func NewInstaller(installPath embed.FS) *Installer {
 	return &Installer{installPath: installPath}
 }
 
-func (i *Installer) Install() {
-	i.installConfig("config")
+// Installs the default configuration into dir, keeping the files already
+// there
+func (i *Installer) Install(dir string) error {
+	return i.installConfig("config", dir)
 }
 
-func (i *Installer) installConfig(dir string) {
-	os.MkdirAll(dir, os.FileMode(0o744))
+func (i *Installer) installConfig(src string, dir string) error {
+	if err := os.MkdirAll(dir, os.FileMode(0o755)); err != nil {
+		return err
+	}
 
-	subDir, err := i.installPath.ReadDir(dir)
+	subDir, err := i.installPath.ReadDir(src)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	for _, f := range subDir {
-		fileName := dir + "/" + f.Name()
+		srcName := src + "/" + f.Name()
+		fileName := filepath.Join(dir, f.Name())
 		if f.IsDir() {
-			i.installConfig(fileName)
-		} else {
-			if _, err := os.Stat(fileName); err == nil {
-				continue
+			if err := i.installConfig(srcName, fileName); err != nil {
+				return err
 			}
-			file, err := i.installPath.ReadFile(fileName)
-			if err != nil {
-				log.Fatal(err)
-			}
-			os.WriteFile(fileName, file, os.FileMode(0o744))
+			continue
+		}
+
+		if _, err := os.Stat(fileName); err == nil {
+			continue
+		}
+		file, err := i.installPath.ReadFile(srcName)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(fileName, file, os.FileMode(0o644)); err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
@@ -3,13 +3,14 @@ package config
 import (
 	"fmt"
 	"log"
+	"os"
 	"testing"
 
 	"ohnitiel/prismatic/internal/locale"
 )
 
 func TestFileLoad(t *testing.T) {
-	_, err := locale.Load("")
+	_, err := locale.Load(os.DirFS("../../config/locales"), "")
 	if err != nil {
 		log.Fatalf("Failed to load locale: %v", err)
 	}
@@ -27,3 +28,29 @@ func TestFileLoad(t *testing.T) {
 			conn.Database)
 	}
 }
+
+func TestSessionOver(t *testing.T) {
+	conn := &Connection{SessionConfig: SessionConfig{
+		Isolation:   "read committed",
+		LockTimeout: 5000,
+		Settings:    map[string]string{"search_path": "app", "work_mem": "64MB"},
+	}}
+	env := &Environment{Host: "10.0.0.10", SessionConfig: SessionConfig{
+		Isolation: "serializable",
+		Settings:  map[string]string{"work_mem": "256MB"},
+	}}
+	conn.Resolve(env)
+
+	flags := SessionConfig{LockTimeout: 1000, Settings: map[string]string{"search_path": "audit"}}
+	got := flags.Over(env.SessionConfig)
+	if got.Isolation != "serializable" || got.LockTimeout != 1000 ||
+		got.Settings["search_path"] != "audit" || got.Settings["work_mem"] != "256MB" {
+		t.Errorf("Over() = %+v, want the flags over the environment over the connection", got)
+	}
+	if got := (SessionConfig{LockTimeoutSet: true}).Over(env.SessionConfig); got.LockTimeout != 0 || !got.LockTimeoutSet {
+		t.Errorf("Over() = %+v, want an explicit zero lock timeout kept", got)
+	}
+	if conn.Settings["work_mem"] != "64MB" {
+		t.Errorf("Resolve() changed the connection settings to %v", conn.Settings)
+	}
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"ohnitiel/prismatic/internal/locale"
+
+	"github.com/BurntSushi/toml"
+)
+
+const configFileName = "config.toml"
+
+// Environment variable pointing to the configuration file
+const ConfigEnv = "PRISMATIC_CONFIG"
+
+var ErrConfigNotFound = errors.New("config file not found")
+
+// Returns the directory of the configuration in the user's home, following
+// the XDG base directory specification
+func UserDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "prismatic"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "prismatic"), nil
+}
+
+// Returns the directories searched for config.toml, in order
+func SearchDirs() []string {
+	dirs := []string{"config"}
+	if dir, err := UserDir(); err == nil {
+		dirs = append(dirs, dir)
+	}
+	return append(dirs, filepath.Join("/etc", "prismatic"))
+}
+
+// Returns the configuration file to load. An explicit path, given by the
+// --config flag or PRISMATIC_CONFIG, must exist. Otherwise the first
+// config.toml found in SearchDirs is used
+func Discover(path string) (string, error) {
+	if path == "" {
+		path = os.Getenv(ConfigEnv)
+	}
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("%w: %s", ErrConfigNotFound, path)
+		}
+		return path, nil
+	}
+
+	for _, dir := range SearchDirs() {
+		candidate := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", ErrConfigNotFound
+}
+
+// Resolves the connections and log paths relative to the configuration
+// file. Paths relative to the working directory, as written by older
+// installs, are kept when they only exist there
+func (c *Config) resolvePaths() {
+	c.Paths.Connections = c.relativePath(c.Paths.Connections, c.Paths.Connections)
+	c.Logging.FileOutput = c.relativePath(c.Logging.FileOutput, filepath.Dir(c.Logging.FileOutput))
+}
+
+// Returns the .env file next to the configuration file, or the one in the
+// working directory when only that exists
+func (c *Config) EnvFile() string {
+	return c.relativePath(".env", ".env")
+}
+
+// Returns path relative to the configuration file, unless probe, the file
+// or directory it needs, is only found relative to the working directory
+func (c *Config) relativePath(path string, probe string) string {
+	if path == "" || filepath.IsAbs(path) || c.Path == "" {
+		return path
+	}
+
+	dir := filepath.Dir(c.Path)
+	if _, err := os.Stat(filepath.Join(dir, probe)); err != nil {
+		if _, err := os.Stat(probe); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dir, path)
+}
+
+// Returns the locale set by the configuration file at path, empty when it
+// can't be read. It only picks the language of the help, before the
+// command line selects the configuration to load
+func PeekLocale(path string) string {
+	var peek struct {
+		Locale string `toml:"locale"`
+	}
+	if _, err := toml.DecodeFile(path, &peek); err != nil {
+		return ""
+	}
+	return peek.Locale
+}
+
+// Loads the locale from the locales directory next to the configuration
+// file, falling back to the locales built into the binary
+func (c *Config) LoadLocale() (*locale.Locale, error) {
+	if c.Path != "" {
+		dir := filepath.Join(filepath.Dir(c.Path), "locales")
+		if l, err := locale.Load(os.DirFS(dir), c.Locale); err == nil {
+			return l, nil
+		}
+	}
+	if c.Installer == nil {
+		return nil, fmt.Errorf("no locales available")
+	}
+
+	locales, err := fs.Sub(c.Installer.installPath, "config/locales")
+	if err != nil {
+		return nil, err
+	}
+	return locale.Load(locales, c.Locale)
+}
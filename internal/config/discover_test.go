@@ -0,0 +1,65 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	xdg := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	t.Setenv(ConfigEnv, "")
+	t.Chdir(t.TempDir())
+
+	if _, err := Discover(""); !errors.Is(err, ErrConfigNotFound) {
+		t.Fatalf("Discover() error = %v, want ErrConfigNotFound", err)
+	}
+
+	user := filepath.Join(xdg, "prismatic", "config.toml")
+	os.MkdirAll(filepath.Dir(user), 0o755)
+	os.WriteFile(user, []byte("[paths]\nconnections = \"connections.toml\"\n"), 0o644)
+	if got, _ := Discover(""); got != user {
+		t.Errorf("Discover() = %q, want %q", got, user)
+	}
+
+	os.MkdirAll("config", 0o755)
+	os.WriteFile(filepath.Join("config", "config.toml"), nil, 0o644)
+	if got, _ := Discover(""); got != filepath.Join("config", "config.toml") {
+		t.Errorf("Discover() = %q, want the working directory config first", got)
+	}
+
+	t.Setenv(ConfigEnv, user)
+	if got, _ := Discover(""); got != user {
+		t.Errorf("Discover() = %q, want %s to take precedence", got, ConfigEnv)
+	}
+	if _, err := Discover("missing.toml"); !errors.Is(err, ErrConfigNotFound) {
+		t.Errorf("Discover(missing.toml) error = %v, want ErrConfigNotFound", err)
+	}
+
+	conf, err := FromFile(user)
+	if err != nil {
+		t.Fatalf("FromFile() error = %v", err)
+	}
+	if want := filepath.Join(xdg, "prismatic", "connections.toml"); conf.Paths.Connections != want {
+		t.Errorf("Paths.Connections = %q, want %q", conf.Paths.Connections, want)
+	}
+	if want := filepath.Join(xdg, "prismatic", ".env"); conf.EnvFile() != want {
+		t.Errorf("EnvFile() = %q, want %q", conf.EnvFile(), want)
+	}
+
+	os.WriteFile(user, []byte("locale = \"pt-BR\"\nmax_workers = \"five\"\n"), 0o644)
+	if got := PeekLocale(user); got != "pt-BR" {
+		t.Errorf("PeekLocale() = %q, want the locale of a file that doesn't load", got)
+	}
+	if got := PeekLocale("missing.toml"); got != "" {
+		t.Errorf("PeekLocale(missing.toml) = %q, want none", got)
+	}
+
+	// Kept in the working directory while only found there
+	os.WriteFile(".env", nil, 0o644)
+	if got := conf.EnvFile(); got != ".env" {
+		t.Errorf("EnvFile() = %q, want the working directory .env", got)
+	}
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"ohnitiel/prismatic/internal/secrets"
+)
+
+// Matches password assignments on a single line, keeping the key, the
+// quoted value and anything after it (e.g. a comment)
+var passwordLine = regexp.MustCompile(`^(\s*(?:password|sslpassword)\s*=\s*)("(?:[^"\\]|\\.)*"|'[^']*')(.*)$`)
+
+// Reads the connections file, decrypting it when it is fully encrypted
+func (c *Config) ReadConnectionsFile() ([]byte, error) {
+	data, err := os.ReadFile(c.Paths.Connections)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading connections TOML: %w", err)
+	}
+
+	if !secrets.IsEncryptedFile(data) {
+		return data, nil
+	}
+
+	cipher, err := c.cipher()
+	if err != nil {
+		return nil, err
+	}
+	return cipher.DecryptFile(data)
+}
+
+func (c *Config) cipher() (*secrets.Cipher, error) {
+	material, err := secrets.KeyMaterial(c.Secrets.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return secrets.NewCipher(material)
+}
+
+// Encrypts the connections file in place. With wholeFile the entire file is
+// encrypted, otherwise only the plaintext password values, keeping the rest
+// of the file readable. Secret references such as ${VAR} are left untouched
+func (c *Config) EncryptConnectionsFile(wholeFile bool) error {
+	data, err := c.ReadConnectionsFile()
+	if err != nil {
+		return err
+	}
+
+	cipher, err := c.cipher()
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	if wholeFile {
+		out, err = cipher.EncryptFile(data)
+	} else {
+		out, err = rewritePasswords(data, func(value string) (string, error) {
+			if secrets.IsReference(value) {
+				return value, nil
+			}
+			return cipher.EncryptValue(value)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(c.Paths.Connections, out, 0o600)
+}
+
+// Decrypts the connections file in place, both the whole file and every
+// encrypted password value
+func (c *Config) DecryptConnectionsFile() error {
+	data, err := c.ReadConnectionsFile()
+	if err != nil {
+		return err
+	}
+
+	cipher, err := c.cipher()
+	if err != nil {
+		return err
+	}
+
+	out, err := rewritePasswords(data, func(value string) (string, error) {
+		if !secrets.IsEncryptedValue(value) {
+			return value, nil
+		}
+		return cipher.DecryptValue(value)
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(c.Paths.Connections, out, 0o600)
+}
+
+// Replaces every single line password value with the result of fn
+func rewritePasswords(data []byte, fn func(value string) (string, error)) ([]byte, error) {
+	lines := strings.Split(string(data), "\n")
+
+	for i, line := range lines {
+		match := passwordLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		value, err := unquoteTOML(match[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		replaced, err := fn(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if replaced != value {
+			lines[i] = match[1] + QuoteTOML(replaced) + match[3]
+		}
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// Returns the value of a single line TOML basic or literal string
+func unquoteTOML(quoted string) (string, error) {
+	if strings.HasPrefix(quoted, "'") {
+		return strings.Trim(quoted, "'"), nil
+	}
+	return strconv.Unquote(quoted)
+}
+
+// Quotes a value as a TOML basic string
+func QuoteTOML(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Encrypts a single value with the configured key, to be stored as a
+// password of the connections file
+func (c *Config) EncryptValue(value string) (string, error) {
+	cipher, err := c.cipher()
+	if err != nil {
+		return "", err
+	}
+	return cipher.EncryptValue(value)
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+const plainConnections = `[clinic_a]
+engine = "postgresql"
+password = "s3cr\"et" # inline comment
+database = "clinic"
+
+[clinic_a.environment.production]
+host = "10.0.0.10"
+password = '${PROD_PASSWORD}'
+`
+
+func TestEncryptConnectionsFile(t *testing.T) {
+	locale.L = &locale.Locale{}
+	t.Setenv("PRISMATIC_PASSPHRASE", "correct horse battery staple")
+
+	path := filepath.Join(t.TempDir(), "connections.toml")
+	if err := os.WriteFile(path, []byte(plainConnections), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Paths: PathConfigs{Connections: path}}
+
+	if err := cfg.EncryptConnectionsFile(false); err != nil {
+		t.Fatalf("EncryptConnectionsFile() error = %v", err)
+	}
+	encrypted, _ := os.ReadFile(path)
+	if strings.Contains(string(encrypted), "s3cr") {
+		t.Fatal("password is still in plaintext")
+	}
+	if !strings.Contains(string(encrypted), `password = "enc:v1:`) ||
+		!strings.Contains(string(encrypted), "# inline comment") ||
+		!strings.Contains(string(encrypted), "'${PROD_PASSWORD}'") {
+		t.Fatalf("unexpected encrypted file:\n%s", encrypted)
+	}
+
+	if err := cfg.DecryptConnectionsFile(); err != nil {
+		t.Fatalf("DecryptConnectionsFile() error = %v", err)
+	}
+	decrypted, _ := os.ReadFile(path)
+	if string(decrypted) != plainConnections {
+		t.Errorf("round trip mismatch:\n%s", decrypted)
+	}
+}
+
+func TestEncryptWholeConnectionsFile(t *testing.T) {
+	locale.L = &locale.Locale{}
+	t.Setenv("PRISMATIC_PASSPHRASE", "correct horse battery staple")
+
+	path := filepath.Join(t.TempDir(), "connections.toml")
+	if err := os.WriteFile(path, []byte(plainConnections), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Paths: PathConfigs{Connections: path}}
+
+	if err := cfg.EncryptConnectionsFile(true); err != nil {
+		t.Fatalf("EncryptConnectionsFile() error = %v", err)
+	}
+	encrypted, _ := os.ReadFile(path)
+	if strings.Contains(string(encrypted), "clinic_a") {
+		t.Fatal("file is still in plaintext")
+	}
+
+	if err := cfg.LoadConnections(); err != nil {
+		t.Fatalf("LoadConnections() error = %v", err)
+	}
+	if cfg.Connections["clinic_a"] == nil || cfg.Connections["clinic_a"].Password != `s3cr"et` {
+		t.Errorf("connections not decrypted on load: %+v", cfg.Connections["clinic_a"])
+	}
+
+	t.Setenv("PRISMATIC_PASSPHRASE", "wrong")
+	if err := cfg.LoadConnections(); err == nil {
+		t.Error("LoadConnections() with the wrong key should fail")
+	}
+}
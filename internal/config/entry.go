@@ -0,0 +1,201 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"ohnitiel/prismatic/internal/locale"
+	"ohnitiel/prismatic/internal/secrets"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+)
+
+// Formats a connection as a connections file entry, leaving out the empty
+// settings
+func FormatConnection(name string, conn *Connection) string {
+	var b strings.Builder
+	key := formatKey([]string{name})
+
+	fmt.Fprintf(&b, "[%s]\n", key)
+	writeString(&b, "engine", conn.Engine)
+	writeString(&b, "host", conn.Host)
+	writePort(&b, conn.Port)
+	writeString(&b, "database", conn.Database)
+	writeString(&b, "username", conn.Username)
+	writeString(&b, "password", conn.Password)
+	writeString(&b, "service", conn.Service)
+	writeString(&b, "passfile", conn.PassFile)
+	writeTLS(&b, conn.TLSConfig)
+	if conn.QueryTimeout > 0 {
+		fmt.Fprintf(&b, "query_timeout = %d\n", conn.QueryTimeout)
+	}
+	writeString(&b, "group", conn.Group)
+	if len(conn.Tags) > 0 {
+		tags := make([]string, len(conn.Tags))
+		for i, tag := range conn.Tags {
+			tags[i] = QuoteTOML(tag)
+		}
+		fmt.Fprintf(&b, "tags = [%s]\n", strings.Join(tags, ", "))
+	}
+	writeString(&b, "discover", conn.Discover)
+	writeString(&b, "discover_query", conn.DiscoverQuery)
+
+	envNames := make([]string, 0, len(conn.Environment))
+	for envName := range conn.Environment {
+		envNames = append(envNames, envName)
+	}
+	sort.Strings(envNames)
+
+	for _, envName := range envNames {
+		env := conn.Environment[envName]
+
+		fmt.Fprintf(&b, "\n[%s.environment.%s]\n", key, formatKey([]string{envName}))
+		writeString(&b, "host", env.Host)
+		writePort(&b, env.Port)
+		writeString(&b, "database", env.Database)
+		writeString(&b, "username", env.Username)
+		writeString(&b, "password", env.Password)
+		writeString(&b, "service", env.Service)
+		writeTLS(&b, env.TLSConfig)
+	}
+
+	return b.String()
+}
+
+func writeString(b *strings.Builder, key string, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "%s = %s\n", key, QuoteTOML(value))
+	}
+}
+
+func writePort(b *strings.Builder, port uint16) {
+	if port > 0 {
+		fmt.Fprintf(b, "port = %d\n", port)
+	}
+}
+
+func writeTLS(b *strings.Builder, tls TLSConfig) {
+	writeString(b, "sslmode", tls.SSLMode)
+	writeString(b, "sslrootcert", tls.SSLRootCert)
+	writeString(b, "sslcert", tls.SSLCert)
+	writeString(b, "sslkey", tls.SSLKey)
+	writeString(b, "sslpassword", tls.SSLPassword)
+	writeString(b, "sslservername", tls.SSLServerName)
+}
+
+// Appends the connections to the connections file, creating it when
+// missing. Fails without writing when a name is already in use
+func (c *Config) AppendConnections(connections map[string]*Connection) error {
+	path := c.Paths.Connections
+
+	var data []byte
+	if _, err := os.Stat(path); err == nil {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if secrets.IsEncryptedFile(raw) {
+			return fmt.Errorf(locale.L.Errors.ConnectionsFileEncrypted, path)
+		}
+		data = raw
+	}
+
+	existing := make(map[string]any)
+	if _, err := toml.Decode(string(data), &existing); err != nil {
+		return fmt.Errorf("Error loading connections TOML: %w", err)
+	}
+
+	names := make([]string, 0, len(connections))
+	for name := range connections {
+		if _, ok := existing[name]; ok {
+			return fmt.Errorf(locale.L.Errors.ConnectionExists, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.Write(data)
+	for _, name := range names {
+		if b.Len() > 0 {
+			if !strings.HasSuffix(b.String(), "\n") {
+				b.WriteString("\n")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(FormatConnection(name, connections[name]))
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0o600)
+}
+
+// Where add-connection and import keep plaintext passwords: the .env file
+// or encrypted in the connections file
+const (
+	SecretStoreEnv = "env"
+	SecretStoreEnc = "enc"
+)
+
+var nonAlphanumeric = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// Returns the .env variable holding a password, e.g. CLINIC_A_PASSWORD for
+// the connection clinic-a
+func PasswordVariable(parts ...string) string {
+	return nonAlphanumeric.ReplaceAllString(strings.ToUpper(strings.Join(parts, "_")), "_") + "_PASSWORD"
+}
+
+// Stores a plaintext password in the .env file, as variable, or encrypted,
+// returning the value to write in the connections file. Empty passwords and
+// secret references are kept as is. Unless write is set the .env file is
+// left untouched, e.g. for a dry run
+func (c *Config) storePassword(variable, password, store string, write bool) (string, error) {
+	if password == "" || secrets.IsReference(password) {
+		return password, nil
+	}
+	if store == SecretStoreEnc {
+		return c.EncryptValue(password)
+	}
+
+	if write {
+		if err := StoreEnv(c.EnvFile(), variable, password); err != nil {
+			return "", err
+		}
+	}
+	return "${" + variable + "}", nil
+}
+
+// Stores a plaintext password as add-connection does, see storePassword
+func (c *Config) StorePassword(variable, password, store string) (string, error) {
+	return c.storePassword(variable, password, store, true)
+}
+
+// Stores a variable in the .env file and the current environment, so it
+// can be referenced as ${key}
+func StoreEnv(path string, key string, value string) error {
+	line, err := godotenv.Marshal(map[string]string{key: value})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		data, err := os.ReadFile(path)
+		if err == nil && !strings.HasSuffix(string(data), "\n") {
+			line = "\n" + line
+		}
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		return err
+	}
+
+	return os.Setenv(key, value)
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ohnitiel/prismatic/internal/locale"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestAppendConnections(t *testing.T) {
+	locale.L = &locale.Locale{}
+	locale.L.Errors.ConnectionExists = "connection %s exists"
+
+	path := filepath.Join(t.TempDir(), "connections.toml")
+	existing := "# Tenants\n[clinic_a]\nengine = \"postgresql\"\n"
+	os.WriteFile(path, []byte(existing), 0o600)
+	conf := &Config{Paths: PathConfigs{Connections: path}}
+
+	conn := &Connection{
+		Engine:    "postgresql",
+		Database:  "clinic b",
+		Username:  "admin",
+		Password:  "${CLINIC_B_PASSWORD}",
+		Tags:      []string{"region:br"},
+		TLSConfig: TLSConfig{SSLMode: "require"},
+		Environment: map[string]*Environment{
+			"production": {Host: "10.0.0.11", Port: 5433},
+			"staging":    {Host: "10.0.1.11"},
+		},
+	}
+	if err := conf.AppendConnections(map[string]*Connection{"clinic.b": conn}); err != nil {
+		t.Fatalf("AppendConnections() error = %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(data), existing+"\n[\"clinic.b\"]\n") {
+		t.Errorf("entry not appended after the existing content:\n%s", data)
+	}
+
+	var decoded map[string]*Connection
+	if _, err := toml.Decode(string(data), &decoded); err != nil {
+		t.Fatalf("appended file doesn't decode: %v\n%s", err, data)
+	}
+	if !reflect.DeepEqual(decoded["clinic.b"], conn) {
+		t.Errorf("decoded = %+v, want %+v", decoded["clinic.b"], conn)
+	}
+
+	if err := conf.AppendConnections(map[string]*Connection{"clinic_a": conn}); err == nil {
+		t.Error("AppendConnections() should refuse an existing name")
+	}
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+// Prefix of the environment variables overriding configuration fields
+const EnvPrefix = "PRISMATIC_"
+
+// Returns the environment variable overriding a dotted key, e.g.
+// PRISMATIC_LOGGER_CONSOLE_LEVEL for logger.console_level
+func EnvName(key []string) string {
+	return EnvPrefix + strings.ToUpper(strings.Join(key, "_"))
+}
+
+// Overrides the configuration fields set by PRISMATIC_* environment
+// variables. Lists are comma separated, and tables of arbitrary keys (such
+// as connections and selections) can't be overridden
+func (c *Config) ApplyEnv() error {
+	return applyEnv(c, reflect.ValueOf(c).Elem(), nil)
+}
+
+func applyEnv(c *Config, v reflect.Value, key []string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		fieldKey := append(slices.Clone(key), name)
+		switch field.Type.Kind() {
+		case reflect.Map:
+			continue
+		case reflect.Struct:
+			if err := applyEnv(c, v.Field(i), fieldKey); err != nil {
+				return err
+			}
+			continue
+		}
+
+		variable := EnvName(fieldKey)
+		value, ok := os.LookupEnv(variable)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf(locale.L.Errors.InvalidEnvOverride, value, variable)
+		}
+		if c.sources != nil {
+			c.sources[strings.Join(fieldKey, ".")] = "env " + variable
+		}
+	}
+
+	return nil
+}
+
+// Sets a field from its text value
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", field.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// Replaces the ${VAR} references in every string of the connection and its
+// environments. Secrets are left as they are, since they are resolved when
+// the connection is opened
+func (c *Connection) Interpolate() error {
+	return interpolate(reflect.ValueOf(c).Elem())
+}
+
+func interpolate(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		if !v.CanSet() {
+			return nil
+		}
+		expanded, err := expandVariables(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(expanded)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return interpolate(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := interpolate(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Map values can't be set in place, so each is expanded on a copy
+		for _, k := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(k))
+			if err := interpolate(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, value)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("toml"), ",")
+			if slices.Contains(secretKeys, name) {
+				continue
+			}
+			if err := interpolate(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Expands the ${VAR} references in value, failing on unset variables
+func expandVariables(value string) (string, error) {
+	var err error
+	expanded := variableReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := variableReference.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf(locale.L.Errors.UnresolvedVariable, name)
+		}
+		return env
+	})
+
+	return expanded, err
+}
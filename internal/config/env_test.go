@@ -0,0 +1,72 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+func TestApplyEnv(t *testing.T) {
+	locale.L = &locale.Locale{}
+	locale.L.Errors.InvalidEnvOverride = "invalid %s in %s"
+
+	t.Setenv("PRISMATIC_MAX_WORKERS", "12")
+	t.Setenv("PRISMATIC_LOGGER_CONSOLE_LEVEL", "debug")
+	t.Setenv("PRISMATIC_CACHE_USE_CACHE", "false")
+	t.Setenv("PRISMATIC_RETRY_RETRYABLE", "40001, 08")
+
+	conf := &Config{Cache: CacheConfig{UseCache: true}, Logging: LoggerConfigs{ConsoleLevel: "info"}}
+	if err := conf.ApplyEnv(); err != nil {
+		t.Fatalf("ApplyEnv() error = %v", err)
+	}
+
+	if conf.MaxWorkers != 12 || conf.Logging.ConsoleLevel != "debug" || conf.Cache.UseCache {
+		t.Errorf("ApplyEnv() = %+v, want the overridden values", conf)
+	}
+	if want := []string{"40001", "08"}; !reflect.DeepEqual(conf.Retry.Retryable, want) {
+		t.Errorf("Retry.Retryable = %v, want %v", conf.Retry.Retryable, want)
+	}
+
+	t.Setenv("PRISMATIC_MAX_WORKERS", "many")
+	if err := conf.ApplyEnv(); err == nil {
+		t.Error("ApplyEnv() should fail on an invalid number")
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	locale.L = &locale.Locale{}
+	locale.L.Errors.UnresolvedVariable = "%s is not set"
+
+	t.Setenv("REGION", "br")
+	t.Setenv("DB_PASSWORD", "secret")
+
+	conn := &Connection{
+		Host:     "db-${REGION}.internal",
+		Password: "${DB_PASSWORD}",
+		Tags:     []string{"region:${REGION}"},
+		SessionConfig: SessionConfig{
+			Settings: map[string]string{"search_path": "app_${REGION},public"},
+		},
+		Environment: map[string]*Environment{
+			"production": {Database: "clinic_${REGION}", SSH: &SSHConfig{Host: "bastion-${REGION}"}},
+		},
+	}
+	if err := conn.Interpolate(); err != nil {
+		t.Fatalf("Interpolate() error = %v", err)
+	}
+
+	env := conn.Environment["production"]
+	if conn.Host != "db-br.internal" || conn.Tags[0] != "region:br" ||
+		env.Database != "clinic_br" || env.SSH.Host != "bastion-br" ||
+		conn.Settings["search_path"] != "app_br,public" {
+		t.Errorf("Interpolate() = %+v, %+v", conn, env)
+	}
+	if conn.Password != "${DB_PASSWORD}" {
+		t.Errorf("Password = %q, want the secret reference kept", conn.Password)
+	}
+
+	if err := (&Connection{Database: "${UNSET_VARIABLE}"}).Interpolate(); err == nil {
+		t.Error("Interpolate() should fail on an unset variable")
+	}
+}
@@ -0,0 +1,386 @@
+package config
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+// Formats accepted by ImportConnections
+const (
+	ImportCSV     = "csv"
+	ImportJSON    = "json"
+	ImportService = "service"
+	ImportURI     = "uri"
+)
+
+// A connection environment read from an inventory
+type importRecord struct {
+	name        string
+	environment string
+	engine      string
+	group       string
+	tags        []string
+	env         Environment
+}
+
+// Replaces the plaintext passwords of imported connections with .env
+// references or encrypted values, so they are never written in plaintext.
+// Unless write is set the .env file is left untouched
+func (c *Config) StorePasswords(connections map[string]*Connection, store string, write bool) error {
+	for _, name := range slices.Sorted(maps.Keys(connections)) {
+		conn := connections[name]
+
+		var err error
+		if conn.Password, err = c.storePassword(PasswordVariable(name), conn.Password, store, write); err != nil {
+			return err
+		}
+		for _, envName := range slices.Sorted(maps.Keys(conn.Environment)) {
+			env := conn.Environment[envName]
+			if env.Password, err = c.storePassword(PasswordVariable(name, envName), env.Password, store, write); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the import format of a file from its extension. Files that
+// aren't CSV, JSON or a service file are read as a URI list
+func ImportFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return ImportCSV
+	case ".json":
+		return ImportJSON
+	case ".conf":
+		return ImportService
+	default:
+		return ImportURI
+	}
+}
+
+// Reads connections from an inventory in the given format.
+// Entries without an environment are mapped by envMap, whose keys are name
+// suffixes (e.g. "_prod") and values environments, and fall back to
+// defaultEnv. Entries sharing a name become environments of one connection
+func ImportConnections(
+	r io.Reader, format string, defaultEnv string, envMap map[string]string,
+) (map[string]*Connection, error) {
+	var records []importRecord
+	var err error
+
+	switch format {
+	case ImportCSV:
+		records, err = readCSV(r)
+	case ImportJSON:
+		records, err = readJSON(r)
+	case ImportService:
+		records, err = readServiceFile(r)
+	case ImportURI:
+		records, err = readURIs(r)
+	default:
+		return nil, fmt.Errorf(locale.L.Errors.UnknownImportFormat, format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	connections := make(map[string]*Connection)
+	for _, record := range records {
+		if record.environment == "" {
+			record.name, record.environment = mapEnvironment(record.name, envMap, defaultEnv)
+		}
+		if record.name == "" {
+			return nil, fmt.Errorf(locale.L.Errors.MissingField, format, "name")
+		}
+
+		conn, ok := connections[record.name]
+		if !ok {
+			conn = &Connection{Engine: "postgresql", Environment: make(map[string]*Environment)}
+			connections[record.name] = conn
+		}
+		if _, exists := conn.Environment[record.environment]; exists {
+			return nil, fmt.Errorf(locale.L.Errors.DuplicateImport, record.name, record.environment)
+		}
+
+		env := record.env
+		conn.Environment[record.environment] = &env
+		if record.engine != "" {
+			conn.Engine = record.engine
+		}
+		if record.group != "" {
+			conn.Group = record.group
+		}
+		if len(record.tags) > 0 {
+			conn.Tags = record.tags
+		}
+	}
+
+	for _, conn := range connections {
+		hoist(conn)
+	}
+
+	return connections, nil
+}
+
+// Splits the environment suffix of a name, e.g. clinic_a_prod becomes
+// clinic_a in production when envMap maps _prod to production
+func mapEnvironment(name string, envMap map[string]string, defaultEnv string) (string, string) {
+	longest := ""
+	for suffix := range envMap {
+		if strings.HasSuffix(name, suffix) && len(suffix) > len(longest) && len(suffix) < len(name) {
+			longest = suffix
+		}
+	}
+	if longest == "" {
+		return name, defaultEnv
+	}
+	return strings.TrimSuffix(name, longest), envMap[longest]
+}
+
+// Moves the settings shared by every environment to the connection
+func hoist(conn *Connection) {
+	shared := func(get func(*Environment) string, set func(*Environment, string)) string {
+		value := ""
+		for _, env := range conn.Environment {
+			v := get(env)
+			if v == "" || (value != "" && v != value) {
+				return ""
+			}
+			value = v
+		}
+		for _, env := range conn.Environment {
+			set(env, "")
+		}
+		return value
+	}
+
+	conn.Database = shared(
+		func(e *Environment) string { return e.Database },
+		func(e *Environment, v string) { e.Database = v },
+	)
+	conn.Username = shared(
+		func(e *Environment) string { return e.Username },
+		func(e *Environment, v string) { e.Username = v },
+	)
+	conn.Password = shared(
+		func(e *Environment) string { return e.Password },
+		func(e *Environment, v string) { e.Password = v },
+	)
+	conn.SSLMode = shared(
+		func(e *Environment) string { return e.SSLMode },
+		func(e *Environment, v string) { e.SSLMode = v },
+	)
+	port := shared(
+		func(e *Environment) string {
+			if e.Port == 0 {
+				return ""
+			}
+			return strconv.Itoa(int(e.Port))
+		},
+		func(e *Environment, v string) { e.Port = 0 },
+	)
+	if port != "" {
+		number, _ := strconv.ParseUint(port, 10, 16)
+		conn.Port = uint16(number)
+	}
+}
+
+// Builds a record from named fields, as found in CSV and JSON inventories
+func recordFromFields(fields map[string]string) (importRecord, error) {
+	record := importRecord{
+		name:        fields["name"],
+		environment: fields["environment"],
+		engine:      fields["engine"],
+		group:       fields["group"],
+		env: Environment{
+			Host:     fields["host"],
+			Database: fields["database"],
+			Username: fields["username"],
+			Password: fields["password"],
+			Service:  fields["service"],
+		},
+	}
+	record.env.SSLMode = fields["sslmode"]
+
+	if port := fields["port"]; port != "" {
+		number, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return record, fmt.Errorf(locale.L.Errors.InvalidPort, port)
+		}
+		record.env.Port = uint16(number)
+	}
+	if tags := fields["tags"]; tags != "" {
+		for _, tag := range strings.FieldsFunc(tags, func(r rune) bool { return r == ';' || r == '|' }) {
+			record.tags = append(record.tags, strings.TrimSpace(tag))
+		}
+	}
+
+	return record, nil
+}
+
+// Column names accepted for each field
+var fieldAliases = map[string]string{
+	"env":      "environment",
+	"dbname":   "database",
+	"db":       "database",
+	"user":     "username",
+	"hostname": "host",
+	"tag":      "tags",
+}
+
+func normalizeField(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := fieldAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+func readCSV(r io.Reader) ([]importRecord, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = normalizeField(header[i])
+	}
+
+	var records []importRecord
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		fields := make(map[string]string, len(header))
+		for i, value := range row {
+			fields[header[i]] = strings.TrimSpace(value)
+		}
+		record, err := recordFromFields(fields)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func readJSON(r io.Reader) ([]importRecord, error) {
+	var entries []map[string]any
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	records := make([]importRecord, 0, len(entries))
+	for _, entry := range entries {
+		fields := make(map[string]string, len(entry))
+		for key, value := range entry {
+			switch v := value.(type) {
+			case []any:
+				tags := make([]string, len(v))
+				for i, tag := range v {
+					tags[i] = fmt.Sprint(tag)
+				}
+				fields[normalizeField(key)] = strings.Join(tags, ";")
+			case nil:
+			default:
+				fields[normalizeField(key)] = fmt.Sprint(v)
+			}
+		}
+
+		record, err := recordFromFields(fields)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// Reads the sections of a pg_service.conf file. Entries reference their
+// service, so the credentials stay in the service and password files
+func readServiceFile(r io.Reader) ([]importRecord, error) {
+	var records []importRecord
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+			continue
+		}
+
+		service := strings.TrimSpace(line[1 : len(line)-1])
+		records = append(records, importRecord{name: service, env: Environment{Service: service}})
+	}
+
+	return records, scanner.Err()
+}
+
+// Reads a list of libpq URIs, one per line, optionally preceded by the
+// connection name. Unnamed entries are named after their database
+func readURIs(r io.Reader) ([]importRecord, error) {
+	var records []importRecord
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, uri, named := strings.Cut(line, " ")
+		if !named {
+			name, uri = "", line
+		}
+
+		parsed, err := url.Parse(strings.TrimSpace(uri))
+		if err != nil || (parsed.Scheme != "postgres" && parsed.Scheme != "postgresql") {
+			return nil, fmt.Errorf(locale.L.Errors.InvalidURI, uri)
+		}
+
+		record := importRecord{
+			name: name,
+			env: Environment{
+				Host:     parsed.Hostname(),
+				Database: strings.TrimPrefix(parsed.Path, "/"),
+				Username: parsed.User.Username(),
+			},
+		}
+		record.env.Password, _ = parsed.User.Password()
+		record.env.SSLMode = parsed.Query().Get("sslmode")
+		if port := parsed.Port(); port != "" {
+			number, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf(locale.L.Errors.InvalidURI, uri)
+			}
+			record.env.Port = uint16(number)
+		}
+		if record.name == "" {
+			record.name = record.env.Database
+		}
+
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"ohnitiel/prismatic/internal/locale"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Environment variable selecting the profile, like --profile
+const ProfileEnv = "PRISMATIC_PROFILE"
+
+// Source of the values left unset by every layer
+const SourceDefault = "default"
+
+// Records where each key set by the configuration file came from
+func (c *Config) trackSources(meta toml.MetaData, lines map[string]int) {
+	c.sources = make(map[string]string)
+	for _, key := range meta.Keys() {
+		if len(key) > 0 && key[0] == "profile" {
+			continue
+		}
+		name := key.String()
+		c.sources[name] = fmt.Sprintf("%s:%d", c.Path, lines[name])
+	}
+}
+
+// Merges the selected profile over the values read from the file
+func (c *Config) applyProfile(lines map[string]int) error {
+	profile, ok := c.Profiles[c.Profile]
+	if !ok {
+		return fmt.Errorf(locale.L.Errors.UnknownProfile, c.Profile)
+	}
+
+	data, err := encodeTable(profile)
+	if err != nil {
+		return err
+	}
+	meta, err := toml.Decode(data, c)
+	if err != nil {
+		return fmt.Errorf("profile %s: %w", c.Profile, err)
+	}
+
+	prefix := "profile." + c.Profile + "."
+	for _, key := range meta.Keys() {
+		name := key.String()
+		c.sources[name] = fmt.Sprintf("%s%s (%s:%d)", prefix, name, c.Path, lines[prefix+name])
+	}
+
+	return nil
+}
+
+// Reports the unknown keys of every profile
+func (c *Config) validateProfiles(path string, lines map[string]int) []Diagnostic {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var diagnostics []Diagnostic
+	for _, name := range names {
+		data, err := encodeTable(c.Profiles[name])
+		if err != nil {
+			diagnostics = append(diagnostics, Diagnostic{path, lines["profile."+name], err.Error()})
+			continue
+		}
+
+		meta, err := toml.Decode(data, NewConfig())
+		if err != nil {
+			diagnostics = append(diagnostics, Diagnostic{path, lines["profile."+name], err.Error()})
+			continue
+		}
+		for _, key := range meta.Undecoded() {
+			full := "profile." + name + "." + key.String()
+			diagnostics = append(diagnostics, Diagnostic{
+				path, lines[full], fmt.Sprintf(locale.L.Errors.UnknownKey, full),
+			})
+		}
+	}
+
+	return diagnostics
+}
+
+// Encodes a table back to TOML, so it can be decoded over a Config
+func encodeTable(table map[string]any) (string, error) {
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(table); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Returns the source of a dotted key
+func (c *Config) source(key string) string {
+	if source, ok := c.sources[key]; ok {
+		return source
+	}
+	return SourceDefault
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+func TestProfile(t *testing.T) {
+	locale.L = &locale.Locale{}
+	locale.L.Errors.UnknownProfile = "unknown profile %s"
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`max_workers = 5
+run_timeout = 60
+
+[logger]
+console_level = "info"
+
+[profile.night_batch]
+max_workers = 20
+
+[profile.night_batch.logger]
+console_level = "warn"
+`), 0o644)
+	t.Setenv("PRISMATIC_RUN_TIMEOUT", "3600")
+
+	conf := &Config{Profile: "night_batch"}
+	if err := conf.UpdateFromFile(path); err != nil {
+		t.Fatalf("UpdateFromFile() error = %v", err)
+	}
+	if conf.MaxWorkers != 20 || conf.Logging.ConsoleLevel != "warn" || conf.RunTimeout != 3600 {
+		t.Errorf("UpdateFromFile() = %+v, want the profile and environment merged", conf)
+	}
+
+	var b strings.Builder
+	if err := conf.ShowEffective(&b, "", FormatTOML); err != nil {
+		t.Fatalf("ShowEffective() error = %v", err)
+	}
+	for _, want := range []string{
+		"max_workers = 20 # profile.night_batch.max_workers (" + path + ":8)",
+		"logger.console_level = \"warn\" # profile.night_batch.logger.console_level (" + path + ":11)",
+		"run_timeout = 3600 # env PRISMATIC_RUN_TIMEOUT",
+		"max_retries = 0 # default",
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("ShowEffective() is missing %q in\n%s", want, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "profile.night_batch =") {
+		t.Errorf("ShowEffective() should leave the profiles out")
+	}
+
+	if err := (&Config{Profile: "missing"}).UpdateFromFile(path); err == nil {
+		t.Error("UpdateFromFile() should fail on an unknown profile")
+	}
+}
+
+func TestReloadProfile(t *testing.T) {
+	locale.L = &locale.Locale{}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`max_workers = 5
+
+[profile.a]
+run_timeout = 60
+
+[profile.b]
+max_workers = 20
+`), 0o644)
+
+	conf := NewConfig()
+	conf.Profile = "a"
+	if err := conf.UpdateFromFile(path); err != nil {
+		t.Fatalf("UpdateFromFile() error = %v", err)
+	}
+
+	conf.Profile = "b"
+	if reloaded, err := conf.Reload(path); err != nil || !reloaded {
+		t.Fatalf("Reload() = %v, %v, want a fresh load for another profile", reloaded, err)
+	}
+	if conf.MaxWorkers != 20 || conf.RunTimeout != 0 {
+		t.Errorf("Reload() = %+v, want only profile b merged", conf)
+	}
+
+	var b strings.Builder
+	if err := conf.ShowEffective(&b, "run_timeout", FormatTOML); err != nil {
+		t.Fatalf("ShowEffective() error = %v", err)
+	}
+	if !strings.Contains(b.String(), "run_timeout = 0 # default") {
+		t.Errorf("ShowEffective() = %q, want the default run_timeout", b.String())
+	}
+
+	if reloaded, err := conf.Reload(path); err != nil || reloaded {
+		t.Errorf("Reload() = %v, %v, want the same file and profile updated in place", reloaded, err)
+	}
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+const (
+	excludePrefix   = "!"
+	tagPrefix       = "tag:"
+	groupPrefix     = "group:"
+	selectionPrefix = "@"
+)
+
+// A single connection pattern: a glob matched against the connection name,
+// one of its tags or its group
+type pattern struct {
+	kind string
+	glob string
+}
+
+func (p pattern) matches(name string, conn *Connection) bool {
+	switch p.kind {
+	case tagPrefix:
+		return slices.ContainsFunc(conn.Tags, func(tag string) bool {
+			ok, _ := path.Match(p.glob, tag)
+			return ok
+		})
+	case groupPrefix:
+		ok, _ := path.Match(p.glob, conn.Group)
+		return ok
+	default:
+		ok, _ := path.Match(p.glob, name)
+		return ok
+	}
+}
+
+// Selection decides which connections a run targets.
+// A connection is selected when it matches any include pattern (or there are
+// none) and no exclude pattern
+type Selection struct {
+	include []pattern
+	exclude []pattern
+}
+
+// Parses the --connections values. Each value is one of:
+//
+//	name or glob   clinic_*
+//	tag glob       tag:region:br
+//	group glob     group:legacy
+//	saved          @gold_br, expanded from [selections] in config.toml
+//
+// prefixed with "!" to exclude the matching connections instead
+func ParseSelection(values []string, saved map[string][]string) (*Selection, error) {
+	s := &Selection{}
+	if err := s.add(values, saved, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Selection) add(values []string, saved map[string][]string, seen []string) error {
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		exclude := strings.HasPrefix(value, excludePrefix)
+		value = strings.TrimPrefix(value, excludePrefix)
+
+		if name, ok := strings.CutPrefix(value, selectionPrefix); ok {
+			values, found := saved[name]
+			if !found {
+				return fmt.Errorf(locale.L.Errors.UnknownSelection, name)
+			}
+			if slices.Contains(seen, name) || exclude {
+				return fmt.Errorf(locale.L.Errors.InvalidSelection, value)
+			}
+			if err := s.add(values, saved, append(seen, name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		p := pattern{glob: value}
+		for _, prefix := range []string{tagPrefix, groupPrefix} {
+			if glob, ok := strings.CutPrefix(value, prefix); ok {
+				p = pattern{kind: prefix, glob: glob}
+			}
+		}
+		if _, err := path.Match(p.glob, ""); err != nil {
+			return fmt.Errorf(locale.L.Errors.InvalidSelection, value)
+		}
+
+		if exclude {
+			s.exclude = append(s.exclude, p)
+		} else {
+			s.include = append(s.include, p)
+		}
+	}
+
+	return nil
+}
+
+// Reports whether the connection is selected
+func (s *Selection) Matches(name string, conn *Connection) bool {
+	if s == nil {
+		return true
+	}
+
+	for _, p := range s.exclude {
+		if p.matches(name, conn) {
+			return false
+		}
+	}
+
+	if len(s.include) == 0 {
+		return true
+	}
+	for _, p := range s.include {
+		if p.matches(name, conn) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"slices"
+	"sort"
+	"testing"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+func TestSelection(t *testing.T) {
+	locale.L = &locale.Locale{}
+
+	connections := map[string]*Connection{
+		"clinic_a":   {Tags: []string{"region:br", "tier:gold"}},
+		"clinic_b":   {Tags: []string{"region:us"}},
+		"legacy_one": {Tags: []string{"region:br"}, Group: "legacy"},
+		"hospital":   {Tags: []string{"tier:gold"}},
+	}
+	saved := map[string][]string{
+		"gold":    {"tag:tier:gold"},
+		"br_gold": {"@gold", "!tag:region:us"},
+		"loop":    {"@loop"},
+	}
+
+	tests := []struct {
+		values []string
+		want   []string
+	}{
+		{nil, []string{"clinic_a", "clinic_b", "hospital", "legacy_one"}},
+		{[]string{"clinic_a"}, []string{"clinic_a"}},
+		{[]string{"clinic_*"}, []string{"clinic_a", "clinic_b"}},
+		{[]string{"tag:region:br"}, []string{"clinic_a", "legacy_one"}},
+		{[]string{"tag:region:*", "!legacy_*"}, []string{"clinic_a", "clinic_b"}},
+		{[]string{"!group:legacy"}, []string{"clinic_a", "clinic_b", "hospital"}},
+		{[]string{"@br_gold"}, []string{"clinic_a", "hospital"}},
+	}
+
+	for _, tt := range tests {
+		selection, err := ParseSelection(tt.values, saved)
+		if err != nil {
+			t.Fatalf("ParseSelection(%v) error = %v", tt.values, err)
+		}
+
+		var got []string
+		for name, conn := range connections {
+			if selection.Matches(name, conn) {
+				got = append(got, name)
+			}
+		}
+		sort.Strings(got)
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("selection %v = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+
+	for _, invalid := range [][]string{{"@missing"}, {"@loop"}, {"clinic_["}} {
+		if _, err := ParseSelection(invalid, saved); err == nil {
+			t.Errorf("ParseSelection(%v) expected an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"ohnitiel/prismatic/internal/locale"
+	"ohnitiel/prismatic/internal/secrets"
+
+	"github.com/BurntSushi/toml"
+)
+
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Sets the dotted key to value in the file holding it, editing the file in
+// place so its comments and layout are kept. Keys under connections are
+// set in the connections file. value is written as is when it is a TOML
+// value (e.g. 5, true or ["a", "b"]) and as a string otherwise
+func (c *Config) Set(key string, value string) error {
+	path, fileKey := c.fileFor(splitKey(key))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if secrets.IsEncryptedFile(data) {
+		return fmt.Errorf(locale.L.Errors.ConnectionsFileEncrypted, path)
+	}
+
+	out, err := setKey(data, fileKey, tomlValue(value))
+	if err != nil {
+		return err
+	}
+
+	// The edited file must still decode into the configuration
+	if path == c.Path {
+		_, err = toml.Decode(string(out), NewConfig())
+	} else {
+		var connections map[string]*Connection
+		_, err = toml.Decode(string(out), &connections)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return os.WriteFile(path, out, info.Mode().Perm())
+}
+
+// Returns the file holding a dotted key and the key within that file
+func (c *Config) fileFor(key []string) (string, []string) {
+	if len(key) > 1 && key[0] == "connections" {
+		return c.Paths.Connections, key[1:]
+	}
+	return c.Path, key
+}
+
+// Returns value as a TOML value, quoting it unless it already is one
+func tomlValue(value string) string {
+	var probe map[string]any
+	if _, err := toml.Decode("value = "+value, &probe); err == nil {
+		return value
+	}
+	return QuoteTOML(value)
+}
+
+// Formats a dotted key, quoting the parts that aren't bare keys
+func formatKey(key []string) string {
+	parts := make([]string, len(key))
+	for i, part := range key {
+		if bareKey.MatchString(part) {
+			parts[i] = part
+		} else {
+			parts[i] = QuoteTOML(part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// Replaces the value of key in a TOML document, or adds the key to its
+// table when it isn't set. A missing table is added at the end
+func setKey(data []byte, key []string, value string) ([]byte, error) {
+	name := strings.Join(key, ".")
+	lines := strings.Split(string(data), "\n")
+
+	if line, ok := keyLines(data)[name]; ok {
+		current := lines[line-1]
+		if strings.HasPrefix(strings.TrimSpace(current), "[") {
+			return nil, fmt.Errorf(locale.L.Errors.NotAValue, name)
+		}
+
+		assignment, rest, _ := strings.Cut(current, "=")
+		end := valueEnd(rest)
+		if end < 0 {
+			return nil, fmt.Errorf(locale.L.Errors.MultilineValue, name)
+		}
+		lines[line-1] = assignment + "= " + value + rest[end:]
+
+		return []byte(strings.Join(lines, "\n")), nil
+	}
+
+	table, leaf := key[:len(key)-1], key[len(key)-1]
+	assignment := formatKey([]string{leaf}) + " = " + value
+
+	start := 0
+	if len(table) > 0 {
+		header, ok := keyLines(data)[strings.Join(table, ".")]
+		if !ok || !strings.HasPrefix(strings.TrimSpace(lines[header-1]), "[") {
+			out := strings.TrimRight(string(data), "\n")
+			out += "\n\n[" + formatKey(table) + "]\n" + assignment + "\n"
+			return []byte(out), nil
+		}
+		start = header
+	}
+
+	// Inserted after the last value of the table
+	insert := start
+	for i := start; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(trimmed, "[") {
+			break
+		}
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			insert = i + 1
+		}
+	}
+	lines = append(lines[:insert], append([]string{assignment}, lines[insert:]...)...)
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// Returns the index where the value starting line ends, keeping what
+// follows it such as a comment. Returns -1 when the value continues on the
+// next lines
+func valueEnd(line string) int {
+	i := len(line) - len(strings.TrimLeft(line, " \t"))
+	if i == len(line) {
+		return -1
+	}
+
+	switch {
+	case strings.HasPrefix(line[i:], `"""`), strings.HasPrefix(line[i:], `'''`):
+		closing := strings.Index(line[i+3:], line[i:i+3])
+		if closing < 0 {
+			return -1
+		}
+		return i + 3 + closing + 3
+	case line[i] == '"' || line[i] == '\'':
+		return stringEnd(line, i)
+	case line[i] == '[' || line[i] == '{':
+		depth := 0
+		for j := i; j < len(line); j++ {
+			switch line[j] {
+			case '"', '\'':
+				if j = stringEnd(line, j) - 1; j < 0 {
+					return -1
+				}
+			case '[', '{':
+				depth++
+			case ']', '}':
+				if depth--; depth == 0 {
+					return j + 1
+				}
+			}
+		}
+		return -1
+	default:
+		end := len(line)
+		if comment := strings.Index(line[i:], "#"); comment >= 0 {
+			end = i + comment
+		}
+		return len(strings.TrimRight(line[:end], " \t"))
+	}
+}
+
+// Returns the index after the string starting at i, or -1 when it isn't
+// closed on the line
+func stringEnd(line string, i int) int {
+	quote := line[i]
+	for j := i + 1; j < len(line); j++ {
+		switch {
+		case line[j] == '\\' && quote == '"':
+			j++
+		case line[j] == quote:
+			return j + 1
+		}
+	}
+	return -1
+}
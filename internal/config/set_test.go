@@ -0,0 +1,77 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+const setDocument = `max_workers = 5 # Number of threads
+
+[logger]
+console_level = "info"   # Console log level
+file_output = "./log/prismatic.log"
+
+[paths]
+connections = "./config/connections.toml"
+`
+
+func TestSetKey(t *testing.T) {
+	locale.L = &locale.Locale{}
+
+	tests := []struct {
+		name  string
+		key   []string
+		value string
+		want  string
+	}{
+		{
+			name: "replaces a value keeping its comment", key: []string{"max_workers"}, value: "8",
+			want: "max_workers = 8 # Number of threads\n",
+		},
+		{
+			name: "replaces a string", key: []string{"logger", "console_level"}, value: tomlValue("debug"),
+			want: "console_level = \"debug\"   # Console log level\n",
+		},
+		{
+			name: "adds a key to its table", key: []string{"logger", "file_level"}, value: tomlValue("warn"),
+			want: "file_output = \"./log/prismatic.log\"\nfile_level = \"warn\"\n\n[paths]",
+		},
+		{
+			name: "adds a missing table", key: []string{"concurrency", "hosts", "10.0.0.10"}, value: "2",
+			want: "\n[concurrency.hosts]\n\"10.0.0.10\" = 2\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := setKey([]byte(setDocument), tt.key, tt.value)
+			if err != nil {
+				t.Fatalf("setKey() error = %v", err)
+			}
+			if !strings.Contains(string(out), tt.want) {
+				t.Errorf("setKey() =\n%s\nwant it to contain\n%s", out, tt.want)
+			}
+		})
+	}
+
+	if _, err := setKey([]byte(setDocument), []string{"paths"}, "1"); err == nil {
+		t.Error("setKey() on a table should fail")
+	}
+}
+
+func TestTOMLValue(t *testing.T) {
+	for value, want := range map[string]string{
+		"5":            "5",
+		"true":         "true",
+		`["a", "b"]`:   `["a", "b"]`,
+		"debug":        `"debug"`,
+		`say "hi"`:     `"say \"hi\""`,
+		"./config/x.t": `"./config/x.t"`,
+	} {
+		if got := tomlValue(value); got != want {
+			t.Errorf("tomlValue(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
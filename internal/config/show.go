@@ -0,0 +1,217 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"ohnitiel/prismatic/internal/locale"
+	"ohnitiel/prismatic/internal/secrets"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Output formats of Show
+const (
+	FormatTOML = "toml"
+	FormatJSON = "json"
+)
+
+const maskedValue = "********"
+
+// Keys holding secrets, masked by Show unless they are secret references
+var secretKeys = []string{"password", "sslpassword"}
+
+// Returns the configuration as written in its files, with the connections
+// file under the connections key
+func (c *Config) tree() (map[string]any, error) {
+	tree := make(map[string]any)
+	if _, err := toml.DecodeFile(c.Path, &tree); err != nil {
+		return nil, fmt.Errorf("Error loading config TOML: %w", err)
+	}
+
+	data, err := c.ReadConnectionsFile()
+	if err != nil {
+		return nil, err
+	}
+	connections := make(map[string]any)
+	if _, err := toml.Decode(string(data), &connections); err != nil {
+		return nil, fmt.Errorf("Error loading connections TOML: %w", err)
+	}
+	tree["connections"] = connections
+
+	return tree, nil
+}
+
+// Writes the value at the dotted key (e.g. connections.my_conn.environment)
+// in the given format, or the whole configuration when key is empty.
+// Passwords are masked unless they are secret references
+func (c *Config) Show(w io.Writer, key string, format string) error {
+	tree, err := c.tree()
+	if err != nil {
+		return err
+	}
+
+	var value any = tree
+	if key != "" {
+		parts := splitKey(key)
+		for _, part := range parts {
+			table, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf(locale.L.Errors.UnknownKey, key)
+			}
+			if value, ok = table[part]; !ok {
+				return fmt.Errorf(locale.L.Errors.UnknownKey, key)
+			}
+		}
+		if slices.Contains(secretKeys, parts[len(parts)-1]) {
+			value = mask(value)
+		}
+	}
+	value = maskSecrets(value)
+
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case FormatTOML, "":
+		if table, ok := value.(map[string]any); ok {
+			return toml.NewEncoder(w).Encode(table)
+		}
+		_, err := fmt.Fprintln(w, value)
+		return err
+	default:
+		return fmt.Errorf(locale.L.Errors.OutputFormatNotImpl, format)
+	}
+}
+
+// Masks the secrets of the tables nested in value
+func maskSecrets(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		masked := make(map[string]any, len(v))
+		for key, nested := range v {
+			if slices.Contains(secretKeys, key) {
+				masked[key] = mask(nested)
+			} else {
+				masked[key] = maskSecrets(nested)
+			}
+		}
+		return masked
+	case []map[string]any:
+		masked := make([]map[string]any, len(v))
+		for i, table := range v {
+			masked[i] = maskSecrets(table).(map[string]any)
+		}
+		return masked
+	}
+	return value
+}
+
+func mask(value any) any {
+	if s, ok := value.(string); ok && (s == "" || secrets.IsReference(s)) {
+		return s
+	}
+	return maskedValue
+}
+
+// A resolved value and where it came from
+type effectiveValue struct {
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+// Writes the resolved configuration, after merging the profile and the
+// environment overrides, with the source of each value. key limits the
+// output to a table or value
+func (c *Config) ShowEffective(w io.Writer, key string, format string) error {
+	values := make(map[string]any)
+	flatten(reflect.ValueOf(c).Elem(), nil, values)
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		if key == "" || k == key || strings.HasPrefix(k, key+".") {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf(locale.L.Errors.UnknownKey, key)
+	}
+	sort.Strings(keys)
+
+	switch format {
+	case FormatJSON:
+		effective := make(map[string]effectiveValue, len(keys))
+		for _, k := range keys {
+			effective[k] = effectiveValue{values[k], c.source(k)}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(effective)
+	case FormatTOML, "":
+		for _, k := range keys {
+			if _, err := fmt.Fprintf(w, "%s = %s # %s\n", k, inlineTOML(values[k]), c.source(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf(locale.L.Errors.OutputFormatNotImpl, format)
+	}
+}
+
+// Collects the values of the configuration by dotted key. Tables of
+// arbitrary keys are kept whole, and connections and profiles left out
+func flatten(v reflect.Value, key []string, values map[string]any) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if name == "" || name == "-" || (key == nil && (name == "connections" || name == "profile")) {
+			continue
+		}
+
+		fieldKey := append(slices.Clone(key), name)
+		if field.Type.Kind() == reflect.Struct {
+			flatten(v.Field(i), fieldKey, values)
+			continue
+		}
+
+		value := v.Field(i).Interface()
+		if slices.Contains(secretKeys, name) {
+			value = mask(value)
+		}
+		values[formatKey(fieldKey)] = value
+	}
+}
+
+// Formats a value as an inline TOML value
+func inlineTOML(value any) string {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String:
+		return QuoteTOML(v.String())
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = inlineTOML(v.Index(i).Interface())
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case reflect.Map:
+		items := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			items = append(items, formatKey([]string{k.String()})+" = "+inlineTOML(v.MapIndex(k).Interface()))
+		}
+		if len(items) == 0 {
+			return "{}"
+		}
+		sort.Strings(items)
+		return "{ " + strings.Join(items, ", ") + " }"
+	default:
+		return fmt.Sprint(value)
+	}
+}
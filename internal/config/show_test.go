@@ -0,0 +1,56 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+func TestShowMasksSecrets(t *testing.T) {
+	locale.L = &locale.Locale{}
+
+	dir := t.TempDir()
+	conf := &Config{
+		Path:  filepath.Join(dir, "config.toml"),
+		Paths: PathConfigs{Connections: filepath.Join(dir, "connections.toml")},
+	}
+	os.WriteFile(conf.Path, []byte("max_workers = 5\n"), 0o600)
+	os.WriteFile(conf.Paths.Connections, []byte(`[clinic_a]
+password = "hunter2"
+
+[clinic_a.environment.production]
+host = "10.0.0.10"
+password = "${PROD_PASSWORD}"
+`), 0o600)
+
+	var out bytes.Buffer
+	if err := conf.Show(&out, "connections.clinic_a", FormatJSON); err != nil {
+		t.Fatalf("Show() error = %v", err)
+	}
+
+	var shown struct {
+		Password    string
+		Environment map[string]map[string]string
+	}
+	if err := json.Unmarshal(out.Bytes(), &shown); err != nil {
+		t.Fatal(err)
+	}
+	if shown.Password != maskedValue {
+		t.Errorf("password = %q, want it masked", shown.Password)
+	}
+	if got := shown.Environment["production"]["password"]; got != "${PROD_PASSWORD}" {
+		t.Errorf("reference = %q, want it shown", got)
+	}
+
+	out.Reset()
+	if err := conf.Show(&out, "connections.clinic_a.environment.production.host", FormatTOML); err != nil {
+		t.Fatalf("Show() error = %v", err)
+	}
+	if out.String() != "10.0.0.10\n" {
+		t.Errorf("Show() = %q, want the bare value", out.String())
+	}
+}
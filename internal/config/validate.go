@@ -0,0 +1,341 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"ohnitiel/prismatic/internal/locale"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Engines supported by the connections
+var SupportedEngines = append([]string{"postgres", "postgresql"}, FileEngines...)
+
+// Engines whose database is a local file, needing no host
+var FileEngines = []string{"sqlite", "sqlite3"}
+
+// Adds engines to the supported ones, as their drivers are registered
+func RegisterEngine(file bool, engines ...string) {
+	for _, engine := range engines {
+		if !slices.Contains(SupportedEngines, engine) {
+			SupportedEngines = append(SupportedEngines, engine)
+		}
+		if file && !slices.Contains(FileEngines, engine) {
+			FileEngines = append(FileEngines, engine)
+		}
+	}
+}
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// Transaction isolation levels, empty keeping the server default
+var IsolationLevels = []string{"read uncommitted", "read committed", "repeatable read", "serializable"}
+
+// Reports whether name is an isolation level, written either as in SQL or
+// with dashes, as in --isolation repeatable-read
+func IsIsolationLevel(name string) bool {
+	return name == "" || slices.Contains(IsolationLevels, strings.ReplaceAll(strings.ToLower(name), "-", " "))
+}
+
+// Matches ${VAR} references
+var variableReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// A problem found in a configuration file. Line is 0 when the problem
+// isn't tied to a line
+type Diagnostic struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return fmt.Sprintf("%s: %s", d.File, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+}
+
+// Checks the configuration file at path and the connections file it points
+// to, returning every problem found sorted by file and line
+func Validate(path string) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	conf := NewConfig()
+	// Profiles hold arbitrary tables, checked by validateProfiles
+	found, lines := decodeFile(path, nil, conf, "profile")
+	diagnostics = append(diagnostics, found...)
+	// The rest of a file that doesn't decode is never loaded
+	if lines == nil {
+		return diagnostics
+	}
+	diagnostics = append(diagnostics, conf.validateProfiles(path, lines)...)
+	conf.Path = path
+	conf.resolvePaths()
+
+	for _, level := range []struct{ key, value string }{
+		{"logger.console_level", conf.Logging.ConsoleLevel},
+		{"logger.file_level", conf.Logging.FileLevel},
+	} {
+		if level.value != "" && !slices.Contains(logLevels, strings.ToLower(level.value)) {
+			diagnostics = append(diagnostics, Diagnostic{
+				path, lines[level.key], fmt.Sprintf(locale.L.Errors.InvalidLogLevel, level.value),
+			})
+		}
+	}
+	if isolation := conf.Transaction.ReadIsolation; !IsIsolationLevel(isolation) {
+		diagnostics = append(diagnostics, Diagnostic{
+			path, lines["transaction.read_isolation"],
+			fmt.Sprintf(locale.L.Errors.InvalidIsolation, isolation, strings.Join(IsolationLevels, ", ")),
+		})
+	}
+	if err := conf.validateLoggerConfig(); err != nil {
+		diagnostics = append(diagnostics, Diagnostic{path, lines["logger.console_output"], err.Error()})
+	}
+
+	if conf.Paths.Connections != "" {
+		diagnostics = append(diagnostics, conf.validateConnections()...)
+	}
+
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		if diagnostics[i].File != diagnostics[j].File {
+			return diagnostics[i].File < diagnostics[j].File
+		}
+		return diagnostics[i].Line < diagnostics[j].Line
+	})
+
+	return diagnostics
+}
+
+// Decoding error of a value, e.g. of the wrong type
+var decodeError = regexp.MustCompile(`^toml: (?:line \d+ )?\(last key "(.+?)"\): (.*)$`)
+
+// Decodes a TOML file into v, reporting parse errors and unknown keys
+// outside the ignored tables. data is read from path when nil. Returns the
+// line of every key
+func decodeFile(path string, data []byte, v any, ignored ...string) ([]Diagnostic, map[string]int) {
+	if data == nil {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return []Diagnostic{{File: path, Message: err.Error()}}, nil
+		}
+	}
+
+	meta, err := toml.Decode(string(data), v)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return []Diagnostic{{path, parseErr.Position.Line, parseErr.Message}}, nil
+		}
+		// Values of the wrong type only name the key they stopped at
+		if match := decodeError.FindStringSubmatch(err.Error()); match != nil {
+			return []Diagnostic{{
+				path, keyLines(data)[match[1]], fmt.Sprintf(locale.L.Errors.InvalidValue, match[1], match[2]),
+			}}, nil
+		}
+		return []Diagnostic{{File: path, Message: err.Error()}}, nil
+	}
+
+	lines := keyLines(data)
+
+	var diagnostics []Diagnostic
+	for _, key := range meta.Undecoded() {
+		if slices.Contains(ignored, key[0]) {
+			continue
+		}
+		name := strings.Join(key, ".")
+		diagnostics = append(diagnostics, Diagnostic{
+			path, lines[name], fmt.Sprintf(locale.L.Errors.UnknownKey, name),
+		})
+	}
+
+	return diagnostics, lines
+}
+
+// Checks the connections file for unknown keys, missing fields, unsupported
+// engines, connections targeting the same database and unset variables
+func (c *Config) validateConnections() []Diagnostic {
+	path := c.Paths.Connections
+
+	data, err := c.ReadConnectionsFile()
+	if err != nil {
+		return []Diagnostic{{File: path, Message: err.Error()}}
+	}
+
+	var connections map[string]*Connection
+	diagnostics, lines := decodeFile(path, data, &connections)
+	if lines == nil {
+		return diagnostics
+	}
+
+	report := func(key string, format string, args ...any) {
+		diagnostics = append(diagnostics, Diagnostic{path, lines[key], fmt.Sprintf(format, args...)})
+	}
+
+	names := make([]string, 0, len(connections))
+	for name := range connections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Connection already targeting each environment, host, port and database
+	targets := make(map[string]string)
+
+	for _, name := range names {
+		conn := connections[name]
+		// Unset variables are reported by the line scan below
+		conn.Interpolate()
+
+		switch {
+		case conn.Engine == "":
+			report(name, locale.L.Errors.MissingField, name, "engine")
+		case !slices.Contains(SupportedEngines, conn.Engine):
+			report(name+".engine", locale.L.Errors.UnsupportedEngine, conn.Engine)
+		}
+		if !IsIsolationLevel(conn.Isolation) {
+			report(name+".isolation", locale.L.Errors.InvalidIsolation, conn.Isolation, strings.Join(IsolationLevels, ", "))
+		}
+
+		envNames := make([]string, 0, len(conn.Environment))
+		for envName := range conn.Environment {
+			envNames = append(envNames, envName)
+		}
+		sort.Strings(envNames)
+
+		for _, envName := range envNames {
+			key := name + ".environment." + envName
+			env := *conn.Environment[envName]
+
+			if env.Disabled {
+				continue
+			}
+			if env.Host == "" && env.Service == "" && conn.Service == "" && !conn.IsFile() {
+				report(key, locale.L.Errors.MissingField, key, "host")
+				continue
+			}
+			if !IsIsolationLevel(env.Isolation) {
+				report(key+".isolation", locale.L.Errors.InvalidIsolation, env.Isolation, strings.Join(IsolationLevels, ", "))
+			}
+			conn.Resolve(&env)
+
+			if env.Database == "" && env.Service == "" && !conn.IsDiscovery() {
+				report(key, locale.L.Errors.MissingField, key, "database")
+			}
+
+			if strings.HasPrefix(env.Password, "env:") {
+				variable := strings.TrimPrefix(env.Password, "env:")
+				if _, ok := os.LookupEnv(variable); !ok {
+					report(key, locale.L.Errors.UnresolvedVariable, variable)
+				}
+			}
+
+			if env.Host == "" || conn.IsDiscovery() {
+				continue
+			}
+			target := fmt.Sprintf("%s|%s|%d|%s", envName, env.Host, env.Port, env.Database)
+			if other, ok := targets[target]; ok {
+				report(key, locale.L.Errors.DuplicateTarget, name, other, envName)
+			} else {
+				targets[target] = name
+			}
+		}
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, match := range variableReference.FindAllStringSubmatch(line, -1) {
+			if _, ok := os.LookupEnv(match[1]); !ok {
+				diagnostics = append(diagnostics, Diagnostic{
+					path, i + 1, fmt.Sprintf(locale.L.Errors.UnresolvedVariable, match[1]),
+				})
+			}
+		}
+	}
+
+	return diagnostics
+}
+
+// Returns the line where each key of a TOML document is defined, keyed by
+// its dotted path. Tables are keyed by their header
+func keyLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+
+	var table []string
+	multiline := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		// Skip the content of multi-line strings
+		if multiline != "" {
+			if strings.Count(trimmed, multiline)%2 == 1 {
+				multiline = ""
+			}
+			continue
+		}
+
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			continue
+		case strings.HasPrefix(trimmed, "["):
+			header := strings.TrimLeft(trimmed, "[")
+			if end := strings.Index(header, "]"); end >= 0 {
+				header = header[:end]
+			}
+			table = splitKey(header)
+			setLine(lines, table, i+1)
+		default:
+			key, value, ok := strings.Cut(trimmed, "=")
+			if !ok {
+				continue
+			}
+			setLine(lines, append(slices.Clone(table), splitKey(key)...), i+1)
+
+			for _, quotes := range []string{`"""`, `'''`} {
+				if strings.Count(value, quotes)%2 == 1 {
+					multiline = quotes
+				}
+			}
+		}
+	}
+
+	return lines
+}
+
+func setLine(lines map[string]int, key []string, line int) {
+	name := strings.Join(key, ".")
+	if _, ok := lines[name]; !ok {
+		lines[name] = line
+	}
+}
+
+// Splits a dotted TOML key, removing the quotes of its parts
+func splitKey(key string) []string {
+	var parts []string
+	var part strings.Builder
+	quote := rune(0)
+
+	for _, r := range strings.TrimSpace(key) {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			part.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '.':
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+
+	return append(parts, strings.TrimSpace(part.String()))
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+func TestValidate(t *testing.T) {
+	locale.L = &locale.Locale{}
+	locale.L.Errors.UnknownKey = "unknown key %s"
+	locale.L.Errors.MissingField = "%s missing %s"
+	locale.L.Errors.UnsupportedEngine = "unsupported engine %s"
+	locale.L.Errors.DuplicateTarget = "%s duplicates %s in %s"
+	locale.L.Errors.UnresolvedVariable = "unset %s"
+	locale.L.Errors.InvalidLogLevel = "invalid level %s"
+	locale.L.Errors.InvalidConsoleOutput = "invalid output %s %v"
+
+	dir := t.TempDir()
+	connectionsPath := filepath.Join(dir, "connections.toml")
+	configPath := filepath.Join(dir, "config.toml")
+
+	configFile := `max_workers = 4
+max_workres = 8
+
+[paths]
+connections = "` + connectionsPath + `"
+
+[logger]
+console_level = "verbose"
+console_output = "stderr"
+`
+	connectionsFile := `[clinic_a]
+engine = "postgresql"
+database = "clinic"
+password = "${PRISMATIC_TEST_UNSET}"
+
+[clinic_a.environment.production]
+host = "10.0.0.10"
+prot = 5433
+
+[clinic_b]
+engine = "postgresql"
+database = "clinic"
+
+[clinic_b.environment.production]
+host = "10.0.0.10"
+
+[clinic_b.environment.staging]
+database = "staging"
+
+[legacy]
+engine = "mysql"
+`
+	os.WriteFile(configPath, []byte(configFile), 0o600)
+	os.WriteFile(connectionsPath, []byte(connectionsFile), 0o600)
+
+	var got []string
+	for _, diagnostic := range Validate(configPath) {
+		got = append(got, strings.TrimPrefix(diagnostic.String(), dir+string(filepath.Separator)))
+	}
+
+	want := []string{
+		"config.toml:2: unknown key max_workres",
+		"config.toml:8: invalid level verbose",
+		"connections.toml:4: unset PRISMATIC_TEST_UNSET",
+		"connections.toml:8: unknown key clinic_a.environment.production.prot",
+		"connections.toml:14: clinic_b duplicates clinic_a in production",
+		"connections.toml:17: clinic_b.environment.staging missing host",
+		"connections.toml:21: unsupported engine mysql",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Validate() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestValidateDecodeError(t *testing.T) {
+	locale.L = &locale.Locale{}
+	locale.L.Errors.InvalidValue = "invalid %s: %s"
+
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		file string
+		line int
+		key  string
+	}{
+		{"max_workers = 4\n\nmax_retries = \"five\"\n", 3, "max_retries"},
+		{"max_workers = 4\n\n[logger]\nconsole_level = 5\n", 4, "logger.console_level"},
+	} {
+		path := filepath.Join(dir, "config.toml")
+		os.WriteFile(path, []byte(tt.file), 0o600)
+
+		diagnostics := Validate(path)
+		if len(diagnostics) != 1 || diagnostics[0].Line != tt.line ||
+			!strings.HasPrefix(diagnostics[0].Message, "invalid "+tt.key+": ") {
+			t.Errorf("Validate() = %v, want an invalid %s at line %d", diagnostics, tt.key, tt.line)
+		}
+	}
+}
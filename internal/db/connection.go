@@ -3,11 +3,16 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
+	"strings"
 	"time"
 
 	_ "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 
 	"ohnitiel/prismatic/internal/config"
 	"ohnitiel/prismatic/internal/locale"
@@ -21,10 +26,43 @@ const (
 	transaction
 )
 
+// SQLSTATE raised by the server when statement_timeout is reached
+const queryCanceledCode = "57014"
+
+var (
+	// Returned (wrapped) when a query exceeds its deadline, either the
+	// per-connection query timeout or the overall run timeout
+	ErrQueryTimeout = errors.New("query timeout")
+	// Returned (wrapped) when the run is cancelled, e.g. by an interrupt
+	ErrCancelled = errors.New("cancelled")
+	// Returned (wrapped) when another run holds the lock of the query
+	ErrBusy = errors.New("busy")
+)
+
 type Connection struct {
-	db    *sql.DB
-	err   error
-	state state
+	db           *sql.DB
+	err          error
+	driver       Driver
+	state        state
+	queryTimeout time.Duration
+	isolation    sql.IsolationLevel
+	// Isolation level of the read-only transactions
+	readIsolation sql.IsolationLevel
+	// Nil unless set, as a zero lock timeout turns it off
+	lockTimeout *time.Duration
+	// Parameters set in every transaction, e.g. search_path
+	settings  map[string]string
+	maxIdle   int
+	committed bool
+	limits    []limit
+	retry     RetryPolicy
+	retries   int
+}
+
+// Concurrency limit shared by the connections with the same key
+type limit struct {
+	key  string
+	size int
 }
 
 // Tests the connection.
@@ -32,8 +70,9 @@ type Connection struct {
 // Will attempt up to maxAttempts to handle transient errors
 func (c *Connection) TestConnection(ctx context.Context, name string, maxAttempts uint8) bool {
 	var attempt uint8
+	var err error
 	for attempt = 1; attempt <= maxAttempts; attempt++ {
-		err := c.db.PingContext(ctx)
+		err = c.driver.Ping(ctx, c.db)
 		if err != nil {
 			slog.WarnContext(ctx, locale.L.Logs.ConnectionFailed,
 				"connection", name,
@@ -41,27 +80,31 @@ func (c *Connection) TestConnection(ctx context.Context, name string, maxAttempt
 				"max_attempts", maxAttempts,
 				"error", err,
 			)
-			time.Sleep(time.Second * time.Duration(attempt*2))
+			select {
+			case <-time.After(c.retry.Backoff(int(attempt))):
+			case <-ctx.Done():
+				c.err = classifyError(ctx, name, ctx.Err())
+				return false
+			}
 		} else {
 			return true
 		}
 	}
 	slog.ErrorContext(ctx, locale.L.Logs.ConnectionFailed)
-	c.err = fmt.Errorf("connection to %s timeout", name)
+	c.err = fmt.Errorf("connection to %s timeout: %w", name, err)
 
 	return false
 }
 
 // TODO: Implement caching
-// TODO: Implement connection pooling
 func (c *Connection) ExecuteQuery(
 	ctx context.Context, query string, useCache bool,
-	commitTransaction bool, conf *config.Config,
-	name string, command string,
+	commitTransaction bool, readOnly bool, conf *config.Config,
+	name string, command string, lock *Lock,
 ) (*ResultSet, error) {
 	if ctx.Err() != nil {
 		slog.ErrorContext(ctx, locale.L.Logs.ContextAlreadyCancelled, "connection", name)
-		return nil, ctx.Err()
+		return nil, classifyError(ctx, name, ctx.Err())
 	}
 
 	// if useCache {
@@ -71,49 +114,234 @@ func (c *Connection) ExecuteQuery(
 	// 	}
 	// }
 
-	tx, err := c.db.BeginTx(ctx, nil)
+	opts := &sql.TxOptions{Isolation: c.isolation}
+	if readOnly {
+		opts = &sql.TxOptions{ReadOnly: true, Isolation: c.readIsolation}
+	}
+
+	var res *ResultSet
+	retries, err := c.retry.Do(ctx, name, func() error {
+		return c.WithTransaction(ctx, name, commitTransaction, opts, func(ctx context.Context, tx *sql.Tx) error {
+			if err := c.TryLock(ctx, tx, lock); err != nil {
+				return err
+			}
+
+			stmt, err := tx.PrepareContext(ctx, query)
+			if err != nil {
+				slog.ErrorContext(ctx, locale.L.Logs.ErrorPreparingStatement, "connection", name, "error", err)
+				return err
+			}
+			defer stmt.Close()
+
+			rows, err := stmt.QueryContext(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, locale.L.Logs.ErrorRunningQuery, "error", err)
+				return fmt.Errorf("error running query: %w", err)
+			}
+			defer rows.Close()
+
+			if command == "export" {
+				res, err = getQueryResults(ctx, rows)
+				if err != nil {
+					slog.ErrorContext(ctx, locale.L.Logs.ErrorRunningQuery, "connection", name, "error", err)
+					return err
+				}
+				return nil
+			}
+
+			// Errors raised while executing are only reported once the rows are drained
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				slog.ErrorContext(ctx, locale.L.Logs.ErrorRunningQuery, "connection", name, "error", err)
+				return fmt.Errorf("error running query: %w", err)
+			}
+
+			return nil
+		})
+	})
+	c.retries += retries
 	if err != nil {
-		slog.ErrorContext(ctx, locale.L.Logs.ErrorStartingTransaction, "connection", name, "error", err)
 		return nil, err
 	}
 
-	if commitTransaction {
-		defer slog.InfoContext(ctx, locale.L.Logs.CommittingTransaction, "connection", name)
-		defer tx.Commit()
-	} else {
-		defer slog.InfoContext(ctx, locale.L.Logs.RollingBackTransaction, "connection", name)
-		defer tx.Rollback()
+	// if useCache && cache != nil {
+	// 	cache.Set(name, query, res)
+	// }
+
+	return res, nil
+}
+
+// Runs fn inside a transaction, opened with opts when given.
+// The transaction is committed only when commit is true and fn succeeds,
+// otherwise it is rolled back.
+// When the connection has a query timeout, fn receives a context with that
+// deadline and the engine's server-side timeout is set to match it.
+// The lock timeout and settings of the connection apply to the transaction
+func (c *Connection) WithTransaction(
+	ctx context.Context, name string, commit bool, opts *sql.TxOptions,
+	fn func(ctx context.Context, tx *sql.Tx) error,
+) error {
+	if c.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.queryTimeout)
+		defer cancel()
 	}
 
-	stmt, err := tx.PrepareContext(ctx, query)
+	tx, err := c.db.BeginTx(ctx, opts)
 	if err != nil {
-		slog.ErrorContext(ctx, locale.L.Logs.ErrorPreparingStatement, "connection", name, "error", err)
-		return nil, err
+		slog.ErrorContext(ctx, locale.L.Logs.ErrorStartingTransaction, "connection", name, "error", err)
+		return classifyError(ctx, name, err)
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.QueryContext(ctx)
+	err = c.applySettings(ctx, tx)
+	var reset string
+	if err == nil && opts != nil && opts.ReadOnly {
+		var enable string
+		if enable, reset = c.driver.ReadOnlyStatements(); enable != "" {
+			_, err = tx.ExecContext(ctx, enable)
+		}
+	}
+	if err == nil {
+		err = fn(ctx, tx)
+	}
+	if reset != "" {
+		if _, resetErr := tx.ExecContext(context.WithoutCancel(ctx), reset); err == nil {
+			err = resetErr
+		}
+	}
 	if err != nil {
-		slog.ErrorContext(ctx, locale.L.Logs.ErrorRunningQuery, "error", err)
-		return nil, fmt.Errorf("error running query: %w", err)
+		slog.InfoContext(ctx, locale.L.Logs.RollingBackTransaction, "connection", name)
+		tx.Rollback()
+		return classifyError(ctx, name, err)
 	}
-	defer rows.Close()
 
-	if command == "export" {
-		res, err := getQueryResults(ctx, rows)
-		if err != nil {
-			slog.ErrorContext(ctx, locale.L.Logs.ErrorRunningQuery, "connection", name, "error", err)
-			return nil, err
+	if !commit {
+		slog.InfoContext(ctx, locale.L.Logs.RollingBackTransaction, "connection", name)
+		return tx.Rollback()
+	}
+
+	// Never commit once the run was cancelled or timed out
+	if err := ctx.Err(); err != nil {
+		slog.InfoContext(ctx, locale.L.Logs.RollingBackTransaction, "connection", name)
+		tx.Rollback()
+		return classifyError(ctx, name, err)
+	}
+
+	slog.InfoContext(ctx, locale.L.Logs.CommittingTransaction, "connection", name)
+	if err := tx.Commit(); err != nil {
+		slog.ErrorContext(ctx, locale.L.Logs.ErrorCommittingTransaction, "connection", name, "error", err)
+
+		if c.driver.CommitUncertain(err) && ctx.Err() == nil {
+			err = fmt.Errorf("%w: %w", errCommitUncertain, err)
 		}
+		return classifyError(ctx, name, err)
+	}
+	c.committed = true
+
+	return nil
+}
 
-		return res, nil
+// Takes the advisory lock for the rest of the transaction, failing with
+// ErrBusy when another run holds it. Engines without such locks skip it
+func (c *Connection) TryLock(ctx context.Context, tx *sql.Tx, lock *Lock) error {
+	stmt := c.driver.TryLockStatement()
+	if lock == nil || stmt == "" {
+		return nil
 	}
 
-	// if useCache && cache != nil {
-	// 	cache.Set(name, query, res)
-	// }
+	var acquired bool
+	if err := tx.QueryRowContext(ctx, stmt, lock.Key).Scan(&acquired); err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("%w: %s is held by another run", ErrBusy, lock)
+	}
+	return nil
+}
+
+// Applies the timeouts and settings of the connection to the transaction
+func (c *Connection) applySettings(ctx context.Context, tx *sql.Tx) error {
+	var statements []string
+	if c.queryTimeout > 0 {
+		statements = append(statements, c.driver.TimeoutStatement(c.queryTimeout))
+	}
+	if c.lockTimeout != nil {
+		statements = append(statements, c.driver.LockTimeoutStatement(*c.lockTimeout))
+	}
+	for _, stmt := range statements {
+		if stmt == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.settings)) {
+		if _, err := tx.ExecContext(ctx, c.driver.SettingStatement(), name, c.settings[name]); err != nil {
+			return fmt.Errorf("setting %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Wraps err with ErrQueryTimeout when it was caused by a deadline and with
+// ErrCancelled when the run was cancelled, so those connections can be
+// reported apart from other failures
+func classifyError(ctx context.Context, name string, err error) error {
+	if errors.Is(err, ErrQueryTimeout) || errors.Is(err, ErrCancelled) {
+		return err
+	}
+	if errors.Is(err, ErrBusy) {
+		slog.WarnContext(ctx, locale.L.Logs.ConnectionBusy, "connection", name)
+		return err
+	}
+
+	if errors.Is(err, context.Canceled) {
+		slog.WarnContext(ctx, locale.L.Logs.ConnectionCancelled, "connection", name)
+		return fmt.Errorf("%w: %w", ErrCancelled, err)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &pgErr) && pgErr.Code == queryCanceledCode) {
+		slog.ErrorContext(ctx, locale.L.Logs.QueryTimedOut, "connection", name, "error", err)
+		return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+	}
+	return err
+}
+
+// Returns the isolation level named in the configuration, the server
+// default when empty
+func isolationLevel(name string) (sql.IsolationLevel, error) {
+	switch strings.ReplaceAll(strings.ToLower(name), "-", " ") {
+	case "":
+		return sql.LevelDefault, nil
+	case "read uncommitted":
+		return sql.LevelReadUncommitted, nil
+	case "read committed":
+		return sql.LevelReadCommitted, nil
+	case "repeatable read":
+		return sql.LevelRepeatableRead, nil
+	case "serializable":
+		return sql.LevelSerializable, nil
+	}
+	return 0, fmt.Errorf("invalid isolation level %q", name)
+}
+
+// Returns the number of query retries made on this connection
+func (c *Connection) Retries() int {
+	return c.retries
+}
+
+// Reports whether a transaction was committed on this connection
+func (c *Connection) Committed() bool {
+	return c.committed
+}
 
-	return nil, nil
+// Returns the error found while opening or testing the connection, if any
+func (c *Connection) Err() error {
+	return c.err
 }
 
 func getQueryResults(ctx context.Context, rows *sql.Rows) (*ResultSet, error) {
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/locale"
+)
+
+func TestDiscoveredTargets(t *testing.T) {
+	locale.L = &locale.Locale{}
+	dir := t.TempDir()
+	for _, site := range []string{"site_a", "site_b", "other"} {
+		createSite(t, filepath.Join(dir, site+".db"), site)
+	}
+
+	production := func(database string) map[string]*config.Environment {
+		return map[string]*config.Environment{"production": {Database: database}}
+	}
+	conf := config.NewConfig()
+	conf.MaxWorkers, conf.MaxRetries = 2, 1
+	conf.Paths.Connections = filepath.Join(dir, "connections.toml")
+	conf.Connections = map[string]*config.Connection{
+		// Each file lists every file, so both entries find the same names
+		"sites": {Engine: "sqlite", Discover: "site_*", Environment: production("site_a.db"),
+			DiscoverQuery: "SELECT 'site_a.db' UNION ALL SELECT 'site_b.db' UNION ALL SELECT 'other.db'"},
+		"mirror": {Engine: "sqlite", Environment: production("other.db"),
+			DiscoverQuery: "SELECT 'site_b.db'"},
+		// Clashes with a discovered name, the configured connection wins
+		"sites.site_b.db": {Engine: "sqlite", Environment: production("other.db")},
+		// SQLite has no catalog to discover from without a query
+		"broken": {Engine: "sqlite", Discover: "*", Environment: production("other.db")},
+	}
+
+	ctx := context.Background()
+	manager := NewDatabaseManager()
+	defer manager.Close()
+	manager.connections = make(map[string]*Connection)
+	targets := manager.targets(ctx, conf, "production", nil)
+
+	if names, want := slices.Sorted(maps.Keys(targets)), []string{"mirror.site_b.db", "sites.site_a.db", "sites.site_b.db"}; !slices.Equal(names, want) {
+		t.Errorf("targets() = %v, want %v", names, want)
+	}
+	if got := targets["sites.site_b.db"].env.Database; got != "other.db" {
+		t.Errorf("sites.site_b.db database = %s, want the configured other.db", got)
+	}
+	if got := targets["mirror.site_b.db"]; got.env.Database != "site_b.db" || got.conn.IsDiscovery() {
+		t.Errorf("mirror.site_b.db = %+v, %+v, want a plain connection to site_b.db", got.conn, got.env)
+	}
+	if conn := manager.connections["broken"]; conn == nil || conn.err == nil {
+		t.Errorf("broken = %+v, want the discovery failure", conn)
+	}
+
+	manager.LoadConnections(ctx, conf, "production", nil)
+	results, failures := NewExecutor(manager).ParallelExecution(ctx, conf.MaxWorkers,
+		"SELECT name FROM items", false, false, conf, "export")
+	if got := results["sites.site_a.db"]; got == nil || got.Rows[0][0] != "site_a" || len(failures) != 1 {
+		t.Errorf("export = %v, %v, want site_a from the discovered connection", results, failures)
+	}
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"ohnitiel/prismatic/internal/config"
+	sqlparser "ohnitiel/prismatic/internal/db/sql"
+)
+
+// Dials the database server, e.g. through an SSH tunnel
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Driver holds what differs between database engines: how a connection is
+// opened, how its server is inspected and which settings it supports
+type Driver interface {
+	// Opens the database handle of an environment, its secrets already
+	// resolved. dial is nil unless the connection goes through a tunnel
+	Open(ctx context.Context, conf *config.Config, conn *config.Connection,
+		env *config.Environment, dial DialFunc) (*sql.DB, error)
+	// Adjusts the configured pool settings to the engine defaults
+	Pool(pool config.PoolConfig) config.PoolConfig
+	// Checks that the database can be used
+	Ping(ctx context.Context, db *sql.DB) error
+	// Classifies the statements only this engine has, e.g. PRAGMA on SQLite
+	Classify(query string) (sqlparser.QueryType, bool)
+	// Query listing the databases of a server, empty when the engine has none
+	DatabasesQuery() string
+	// Statement bounding the queries of the current transaction, empty when
+	// the engine only has the client-side timeout
+	TimeoutStatement(timeout time.Duration) string
+	// Statement bounding the wait for locks in the current transaction,
+	// empty when the engine has no such setting
+	LockTimeoutStatement(timeout time.Duration) string
+	// Statement setting a parameter, given as its two arguments, for the
+	// current transaction. Empty when the engine has no such parameters
+	SettingStatement() string
+	// Statements making the current transaction read-only and resetting
+	// the connection afterwards, empty when BeginTx enforces it
+	ReadOnlyStatements() (enable, reset string)
+	// Query trying to take a lock, given as its argument, until the end of
+	// the current transaction. It returns whether the lock was taken, and is
+	// empty when the engine has no such locks
+	TryLockStatement() string
+	// Statements of a two-phase commit under the transaction id: preparing
+	// the current transaction, then committing or rolling back the prepared
+	// one. ok is false when the engine has no two-phase commit
+	TwoPhaseStatements(id string) (prepare, commit, rollback string, ok bool)
+	// Reports whether a failed commit may still have been applied
+	CommitUncertain(err error) bool
+	// Returns the TLS session of a pooled connection, nil when unencrypted
+	TLSState(ctx context.Context, db *sql.DB) (*tls.ConnectionState, error)
+	// Reports whether the database is a local file, without a server
+	Local() bool
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]Driver{
+		"postgres":   PostgresDriver{},
+		"postgresql": PostgresDriver{},
+		"sqlite":     SQLiteDriver{},
+		"sqlite3":    SQLiteDriver{},
+	}
+)
+
+// Registers the driver of an engine under each of its names, replacing any
+// driver previously registered for them
+func Register(driver Driver, engines ...string) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	for _, engine := range engines {
+		drivers[engine] = driver
+	}
+	config.RegisterEngine(driver.Local(), engines...)
+}
+
+// Returns the driver of an engine
+func DriverFor(engine string) (Driver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	driver, ok := drivers[engine]
+	if !ok {
+		return nil, fmt.Errorf("unsupported engine %q, expected one of %s",
+			engine, strings.Join(slices.Sorted(maps.Keys(drivers)), ", "))
+	}
+	return driver, nil
+}
+
+// Returns the first keyword of a statement, upper cased
+func leadingKeyword(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimRight(fields[0], ";"))
+}
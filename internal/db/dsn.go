@@ -0,0 +1,66 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"ohnitiel/prismatic/internal/config"
+)
+
+// Parses the connection settings with pgx, applying the TLS settings
+// that can't be written in a connection string
+func postgresConfig(conf *config.Config, conn *config.Connection, env *config.Environment) (*pgx.ConnConfig, error) {
+	parsed, err := pgx.ParseConfig(postgresDSN(conf, conn, env))
+	if err != nil {
+		return nil, err
+	}
+
+	applyTLS(parsed.TLSConfig, env.SSLServerName)
+	for _, fallback := range parsed.Fallbacks {
+		applyTLS(fallback.TLSConfig, env.SSLServerName)
+	}
+
+	return parsed, nil
+}
+
+// Builds a libpq keyword/value connection string, leaving out empty values so
+// pgx can fill them from the service file, the password file or its defaults
+func postgresDSN(conf *config.Config, conn *config.Connection, env *config.Environment) string {
+	settings := [][2]string{
+		{"service", env.Service},
+		{"host", env.Host},
+		{"dbname", env.Database},
+		{"user", env.Username},
+		{"password", env.Password},
+		{"passfile", conn.PassFile},
+		{"sslmode", env.SSLMode},
+		{"sslrootcert", env.SSLRootCert},
+		{"sslcert", env.SSLCert},
+		{"sslkey", env.SSLKey},
+		{"sslpassword", env.SSLPassword},
+	}
+	if env.Port > 0 {
+		settings = append(settings, [2]string{"port", fmt.Sprint(env.Port)})
+	}
+	if conf.Timeout > 0 {
+		settings = append(settings, [2]string{"connect_timeout", fmt.Sprint(conf.Timeout)})
+	}
+
+	var dsn []string
+	for _, setting := range settings {
+		if setting[1] != "" {
+			dsn = append(dsn, setting[0]+"="+quoteDSNValue(setting[1]))
+		}
+	}
+
+	return strings.Join(dsn, " ")
+}
+
+// Quotes a connection string value, escaping backslashes and single quotes
+func quoteDSNValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"ohnitiel/prismatic/internal/config"
+)
+
+func TestPostgresDSNQuotesValues(t *testing.T) {
+	conf := &config.Config{Timeout: 5}
+	env := &config.Environment{
+		Host: "db.local", Port: 5433, Database: "my db",
+		Username: "admin", Password: `it's a \\secret`,
+	}
+
+	parsed, err := pgx.ParseConfig(postgresDSN(conf, &config.Connection{}, env))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+
+	if parsed.Host != "db.local" || parsed.Port != 5433 || parsed.Database != "my db" ||
+		parsed.User != "admin" || parsed.Password != env.Password {
+		t.Errorf("parsed config = %s@%s:%d/%s (%q), want values of %+v",
+			parsed.User, parsed.Host, parsed.Port, parsed.Database, parsed.Password, env)
+	}
+}
+
+func TestPostgresDSNResolvesPassFileAndService(t *testing.T) {
+	dir := t.TempDir()
+
+	passFile := filepath.Join(dir, "pgpass")
+	if err := os.WriteFile(passFile, []byte("db.tenant.local:5432:tenant_a:reporter:from-pgpass\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	serviceFile := filepath.Join(dir, "pg_service.conf")
+	service := "[tenant_a]\nhost=db.tenant.local\nport=5432\ndbname=tenant_a\nuser=reporter\n"
+	if err := os.WriteFile(serviceFile, []byte(service), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PGPASSFILE", passFile)
+	t.Setenv("PGSERVICEFILE", serviceFile)
+
+	conn := &config.Connection{}
+	env := &config.Environment{Service: "tenant_a"}
+	conn.Resolve(env)
+
+	parsed, err := pgx.ParseConfig(postgresDSN(&config.Config{}, conn, env))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+
+	if parsed.Host != "db.tenant.local" || parsed.Database != "tenant_a" || parsed.User != "reporter" {
+		t.Errorf("service not applied: %s@%s/%s", parsed.User, parsed.Host, parsed.Database)
+	}
+	if parsed.Password != "from-pgpass" {
+		t.Errorf("password = %q, want it resolved from the password file", parsed.Password)
+	}
+}
+
+func TestPostgresConfigAppliesTLSSettings(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "prismatic test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCert := filepath.Join(t.TempDir(), "root.crt")
+	if err := os.WriteFile(rootCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &config.Connection{TLSConfig: config.TLSConfig{
+		SSLMode:     "require",
+		SSLRootCert: rootCert,
+	}}
+	env := &config.Environment{
+		Host:      "10.0.0.10",
+		TLSConfig: config.TLSConfig{SSLMode: "verify-full", SSLServerName: "db.tenant.internal"},
+	}
+	conn.Resolve(env)
+
+	if env.SSLRootCert != rootCert {
+		t.Errorf("sslrootcert = %q, want it inherited from the connection", env.SSLRootCert)
+	}
+
+	parsed, err := postgresConfig(&config.Config{}, conn, env)
+	if err != nil {
+		t.Fatalf("postgresConfig() error = %v", err)
+	}
+	if parsed.TLSConfig == nil || parsed.TLSConfig.RootCAs == nil {
+		t.Fatal("TLS not configured with the root certificate")
+	}
+	if parsed.TLSConfig.InsecureSkipVerify {
+		t.Error("verify-full from the environment should override the connection sslmode")
+	}
+	if parsed.TLSConfig.ServerName != "db.tenant.internal" {
+		t.Errorf("ServerName = %q, want db.tenant.internal", parsed.TLSConfig.ServerName)
+	}
+}
+
+func TestTwoPhaseStatements(t *testing.T) {
+	prepare, commit, rollback, ok := PostgresDriver{}.TwoPhaseStatements("run's 1")
+	if !ok || prepare != "PREPARE TRANSACTION 'run''s 1'" ||
+		commit != "COMMIT PREPARED 'run''s 1'" || rollback != "ROLLBACK PREPARED 'run''s 1'" {
+		t.Errorf("TwoPhaseStatements() = %q, %q, %q, %v", prepare, commit, rollback, ok)
+	}
+	if _, _, _, ok := (SQLiteDriver{}).TwoPhaseStatements("run"); ok {
+		t.Error("TwoPhaseStatements() should refuse two-phase commits on SQLite")
+	}
+}
@@ -2,9 +2,12 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"slices"
+	"sort"
+	"strings"
 	"sync"
 
 	"ohnitiel/prismatic/internal/config"
@@ -20,9 +23,37 @@ type Executor struct {
 type Summary struct {
 	Sucessful int
 	Failed    int
+	TimedOut  int
+	Cancelled int
+	Busy      int
+	Retries   int
 	Errors    map[string]error
 }
 
+// Builds a summary, counting timed out, cancelled and busy connections apart
+// from other failures
+func NewSummary(successful int, failures map[string]error) *Summary {
+	summary := &Summary{Sucessful: successful, Errors: failures}
+
+	for _, err := range failures {
+		if errors.Is(err, ErrQueryTimeout) {
+			summary.TimedOut++
+		} else if errors.Is(err, ErrCancelled) {
+			summary.Cancelled++
+		} else if errors.Is(err, ErrBusy) {
+			summary.Busy++
+		} else {
+			summary.Failed++
+		}
+	}
+
+	return summary
+}
+
+func (s *Summary) String() string {
+	return fmt.Sprintf(locale.L.Logs.QuerySummary, s.Sucessful, s.Failed, s.TimedOut, s.Cancelled, s.Busy, s.Retries)
+}
+
 func NewExecutor(manager *Manager) *Executor {
 	return &Executor{
 		manager: manager,
@@ -30,104 +61,173 @@ func NewExecutor(manager *Manager) *Executor {
 	}
 }
 
-// Executes a query on multiple connections in parallel
-// TODO: Add a caching mechanism when DQL
-// TODO: Make more memory efficient
-func (ex *Executor) ParallelExecution(
-	ctx context.Context, workers uint8, query string, useCache bool,
-	commitTransaction bool, conf *config.Config, command string,
-	connections []string,
-) (map[string]*ResultSet, map[string]error) {
-	type result struct {
-		name string
-		data *ResultSet
-		err  error
-	}
+// Runs fn on every loaded connection, limited to workers at a time and to
+// the host and group limits of each connection.
+// Connections that failed to open are skipped and reported with their error.
+// Returns the errors found, keyed by connection name
+func (ex *Executor) ForEach(
+	ctx context.Context, workers uint8,
+	fn func(ctx context.Context, name string, conn *Connection) error,
+) map[string]error {
 	var wg sync.WaitGroup
-	summary := Summary{Errors: make(map[string]error)}
-
-	resChann := make(chan result, len(ex.manager.connections))
-	sem := make(chan struct{}, workers)
-
-	queryType, err := sql.SimpleQueryIdentifier(query)
-	if err != nil {
-		slog.WarnContext(ctx, locale.L.Logs.UnableIdentifyQueryType)
-	}
-	slog.InfoContext(ctx, locale.L.Logs.IdentifiedQueryType, "query_type", queryType)
+	var mu sync.Mutex
+	errors := make(map[string]error)
 
-	if command == "run" && queryType == sql.DQL {
-		slog.WarnContext(ctx, locale.L.Logs.RunningSelectWithoutSaving)
-	}
+	sem := make(chan struct{}, max(workers, 1))
 
 	for name, conn := range ex.manager.connections {
-		if len(connections) > 0 && !slices.Contains(connections, name) {
-			continue
-		}
-
 		wg.Add(1)
-		name, conn := name, conn
 
 		go func() {
 			defer wg.Done()
 
-			sem <- struct{}{}
-			defer func() { <-sem }()
-
-			if conn.err != nil {
-				slog.ErrorContext(ctx, locale.L.Logs.SkippingConnectionError, "connection", name, "error", conn.err)
-				summary.Errors[name] = conn.err
-				summary.Failed++
-				fmt.Println("Inside conn.err")
-				resChann <- result{name: name, data: nil, err: conn.err}
+			if err := ex.manager.acquireLimits(ctx, conn); err != nil {
+				mu.Lock()
+				errors[name] = classifyError(ctx, name, err)
+				mu.Unlock()
 				return
 			}
-
-			if conn.db == nil {
-				slog.WarnContext(ctx, locale.L.Logs.RunningQueryOnConn, "connection", name)
-				err = fmt.Errorf("connection to %s is null", name)
-				summary.Errors[name] = err
-				summary.Failed++
-				fmt.Println("Null db")
-				resChann <- result{name: name, data: nil, err: err}
+			defer ex.manager.releaseLimits(conn)
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				mu.Lock()
+				errors[name] = classifyError(ctx, name, ctx.Err())
+				mu.Unlock()
 				return
 			}
 
-			slog.InfoContext(ctx, locale.L.Logs.RunningQueryOnConn, "connection", name)
-
-			res, err := conn.ExecuteQuery(ctx, query, useCache, commitTransaction, conf, name, command)
+			var err error
+			switch {
+			case conn.err != nil:
+				slog.ErrorContext(ctx, locale.L.Logs.SkippingConnectionError, "connection", name, "error", conn.err)
+				err = conn.err
+			case conn.db == nil:
+				slog.WarnContext(ctx, locale.L.Logs.SkippingConnectionError, "connection", name)
+				err = fmt.Errorf("connection to %s is null", name)
+			default:
+				if err = ex.manager.acquire(ctx); err != nil {
+					err = classifyError(ctx, name, err)
+					break
+				}
+				err = fn(ctx, name, conn)
+				ex.manager.release(conn)
+			}
 
 			if err != nil {
-				slog.ErrorContext(ctx, locale.L.Logs.ErrorRunningQueryOnConn, "connection", name, "error", err)
-				summary.Failed++
-				summary.Errors[name] = err
-			} else {
-				slog.InfoContext(ctx, locale.L.Logs.QuerySuccessfulOnConn, "connection", name)
-				summary.Sucessful++
+				mu.Lock()
+				errors[name] = err
+				mu.Unlock()
 			}
-
-			resChann <- result{name: name, data: res, err: err}
 		}()
 	}
 
-	go func() {
-		wg.Wait()
-		close(resChann)
-		close(sem)
-	}()
+	wg.Wait()
+	close(sem)
 
-	results := make(map[string]*ResultSet)
-	errors := make(map[string]error)
-	for r := range resChann {
-		if r.err != nil {
-			fmt.Println(r.name)
-			errors[r.name] = r.err
-		} else {
-			results[r.name] = r.data
+	return errors
+}
+
+// Returns the sorted names of the connections where a transaction was committed
+func (ex *Executor) Committed() []string {
+	var names []string
+	for name, conn := range ex.manager.connections {
+		if conn.Committed() {
+			names = append(names, name)
 		}
 	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Identifies the type of a query, asking the drivers of the loaded
+// connections first about the statements only their engine has
+func (dm *Manager) classify(query string) (sql.QueryType, error) {
+	for _, conn := range dm.connections {
+		if conn.driver == nil {
+			continue
+		}
+		if queryType, ok := conn.driver.Classify(query); ok {
+			return queryType, nil
+		}
+	}
+	return sql.SimpleQueryIdentifier(query)
+}
+
+// Reports whether query is a single SELECT or SHOW statement. The query
+// classifier isn't enough, as it takes any query mentioning SELECT for a
+// read. SELECT INTO creates a table, so it isn't a plain read
+func plainRead(query string) bool {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	if strings.Contains(query, ";") {
+		return false
+	}
+
+	switch leadingKeyword(query) {
+	case "SELECT":
+		return !slices.Contains(strings.Fields(strings.ToUpper(query)), "INTO")
+	case "SHOW":
+		return true
+	}
+	return false
+}
+
+// Executes a query on multiple connections in parallel
+// TODO: Add a caching mechanism when DQL
+// TODO: Make more memory efficient
+func (ex *Executor) ParallelExecution(
+	ctx context.Context, workers uint8, query string, useCache bool,
+	commitTransaction bool, conf *config.Config, command string,
+) (map[string]*ResultSet, map[string]error) {
+	var mu sync.Mutex
+	results := make(map[string]*ResultSet)
+
+	queryType, err := ex.manager.classify(query)
+	if err != nil {
+		slog.WarnContext(ctx, locale.L.Logs.UnableIdentifyQueryType)
+	}
+	slog.InfoContext(ctx, locale.L.Logs.IdentifiedQueryType, "query_type", queryType)
 
-	textSummary := fmt.Sprintf(locale.L.Logs.QuerySummary, summary.Sucessful, summary.Failed)
-	fmt.Println(textSummary)
+	if command == "run" && queryType == sql.DQL {
+		slog.WarnContext(ctx, locale.L.Logs.RunningSelectWithoutSaving)
+	}
+
+	// Exports never write, whatever the query classifier says, so the
+	// server itself rejects their writes
+	readOnly := command == "export" || conf.Transaction.ReadOnly
+
+	// Committed runs are kept apart from concurrent runs of the same query,
+	// unless the query is positively a plain read
+	var lock *Lock
+	if command == "run" && commitTransaction && conf.Transaction.Lock && !plainRead(query) {
+		lock = NewLock(conf.Transaction.LockName, query)
+	}
+
+	errors := ex.ForEach(ctx, workers, func(ctx context.Context, name string, conn *Connection) error {
+		slog.InfoContext(ctx, locale.L.Logs.RunningQueryOnConn, "connection", name)
+
+		res, err := conn.ExecuteQuery(ctx, query, useCache, commitTransaction, readOnly, conf, name, command, lock)
+		if err != nil {
+			slog.ErrorContext(ctx, locale.L.Logs.ErrorRunningQueryOnConn, "connection", name, "error", err)
+			return err
+		}
+
+		slog.InfoContext(ctx, locale.L.Logs.QuerySuccessfulOnConn, "connection", name)
+		mu.Lock()
+		results[name] = res
+		mu.Unlock()
+
+		return nil
+	})
+
+	summary := NewSummary(len(results), errors)
+	for _, conn := range ex.manager.connections {
+		summary.Retries += conn.Retries()
+	}
+	fmt.Println(summary)
 
 	return results, errors
 }
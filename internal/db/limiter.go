@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"sync"
+)
+
+// Limiter is a thread-safe set of semaphores, one per key, each created
+// with its own size on first use
+type Limiter struct {
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{slots: make(map[string]chan struct{})}
+}
+
+// Takes a slot for key, waiting until one is free or ctx is done.
+// A size of zero means the key is unlimited
+func (l *Limiter) Acquire(ctx context.Context, key string, size int) error {
+	if size <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	sem, ok := l.slots[key]
+	if !ok {
+		sem = make(chan struct{}, size)
+		l.slots[key] = sem
+	}
+	l.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns a slot taken for key
+func (l *Limiter) Release(key string) {
+	l.mu.Lock()
+	sem, ok := l.slots[key]
+	l.mu.Unlock()
+
+	if ok {
+		<-sem
+	}
+}
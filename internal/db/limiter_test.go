@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterBoundsConcurrencyPerKey(t *testing.T) {
+	limiter := NewLimiter()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var running, peak atomic.Int32
+
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := limiter.Acquire(ctx, "host:db1", 3); err != nil {
+				t.Error(err)
+				return
+			}
+			defer limiter.Release("host:db1")
+
+			current := running.Add(1)
+			for {
+				p := peak.Load()
+				if current <= p || peak.CompareAndSwap(p, current) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > 3 {
+		t.Errorf("peak concurrency = %d, want at most 3", got)
+	}
+}
+
+func TestLimiterUnlimitedAndCancelled(t *testing.T) {
+	limiter := NewLimiter()
+
+	for range 5 {
+		if err := limiter.Acquire(context.Background(), "unlimited", 0); err != nil {
+			t.Fatalf("Acquire() on unlimited key error = %v", err)
+		}
+	}
+
+	if err := limiter.Acquire(context.Background(), "host:db1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.Acquire(ctx, "host:db1", 1); err == nil {
+		t.Fatal("Acquire() on a full key with a cancelled context should fail")
+	}
+}
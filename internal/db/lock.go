@@ -0,0 +1,31 @@
+package db
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Advisory lock held by a run until its transaction ends, so runs using the
+// same lock skip the connections another one is writing to
+type Lock struct {
+	Name string // Empty when the lock is keyed by the query
+	Key  int64
+}
+
+// Returns the lock named name, or keyed by the query when name is empty
+func NewLock(name, query string) *Lock {
+	h := fnv.New64a()
+	if name != "" {
+		h.Write([]byte(name))
+	} else {
+		h.Write([]byte(query))
+	}
+	return &Lock{Name: name, Key: int64(h.Sum64())}
+}
+
+func (l *Lock) String() string {
+	if l.Name != "" {
+		return fmt.Sprintf("lock %s", l.Name)
+	}
+	return fmt.Sprintf("the lock of the query (%d)", l.Key)
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/locale"
+)
+
+// SQLite driver whose lock is always held by another run
+type lockedDriver struct{ SQLiteDriver }
+
+func (lockedDriver) TryLockStatement() string {
+	return "SELECT ? = 0"
+}
+
+func TestCommittedRunLock(t *testing.T) {
+	locale.L = &locale.Locale{}
+	engines, fileEngines := slices.Clone(config.SupportedEngines), slices.Clone(config.FileEngines)
+	Register(lockedDriver{}, "locked")
+	t.Cleanup(func() {
+		driversMu.Lock()
+		delete(drivers, "locked")
+		driversMu.Unlock()
+		config.SupportedEngines, config.FileEngines = engines, fileEngines
+	})
+	dir := t.TempDir()
+	createSite(t, filepath.Join(dir, "site.db"), "apple")
+
+	conf := config.NewConfig()
+	conf.MaxWorkers, conf.MaxRetries = 1, 1
+	conf.Paths.Connections = filepath.Join(dir, "connections.toml")
+	conf.Connections = map[string]*config.Connection{
+		"site": {Engine: "locked", Environment: map[string]*config.Environment{
+			"production": {Database: "site.db"},
+		}},
+	}
+
+	ctx := context.Background()
+	manager := NewDatabaseManager()
+	defer manager.Close()
+	manager.LoadConnections(ctx, conf, "production", nil)
+	executor := NewExecutor(manager)
+
+	update := "UPDATE items SET name = upper(name)"
+	for _, tt := range []struct {
+		name   string
+		query  string
+		commit bool
+		lock   bool
+		busy   bool
+	}{
+		{"committed write", update, true, true, true},
+		{"write mentioning SELECT", "INSERT INTO items (name) SELECT 'cherry'", true, true, true},
+		{"plain read", "SELECT name FROM items", true, true, false},
+		{"dry run", update, false, true, false},
+		{"lock disabled", update, true, false, false},
+	} {
+		conf.Transaction.Lock = tt.lock
+		_, failures := executor.ParallelExecution(ctx, conf.MaxWorkers, tt.query, false, tt.commit, conf, "run")
+		if busy := errors.Is(failures["site"], ErrBusy); busy != tt.busy || (!busy && failures["site"] != nil) {
+			t.Errorf("%s: failures = %v, want busy %v", tt.name, failures, tt.busy)
+		}
+	}
+	if got := NewSummary(0, map[string]error{"site": ErrBusy}).Busy; got != 1 {
+		t.Errorf("NewSummary().Busy = %d, want 1", got)
+	}
+}
@@ -5,22 +5,31 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"maps"
+	"path"
 	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"ohnitiel/prismatic/internal/config"
 	"ohnitiel/prismatic/internal/locale"
-
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"ohnitiel/prismatic/internal/secrets"
 )
 
 // Manager is a thread-safe manager for database connections
 type Manager struct {
 	connections map[string]*Connection
+	// Global connection budget shared by every pool, nil when unlimited
+	budget chan struct{}
+	// Per host and per group concurrency limits
+	limiter *Limiter
+	// SSH tunnels shared by the connections behind the same bastion
+	tunnels *tunnels
 }
 
 func NewDatabaseManager() *Manager {
-	return &Manager{}
+	return &Manager{limiter: NewLimiter(), tunnels: newTunnels()}
 }
 
 func (dm *Manager) GetConnection(name string) *Connection {
@@ -37,16 +46,243 @@ func (dm *Manager) Close() {
 			conn.db.Close()
 		}
 	}
+	dm.tunnels.close()
 }
 
-// Loads the database connections from the configuration
-func (dm *Manager) LoadConnections(ctx context.Context, conf *config.Config, environment string, connections []string) {
-	var wg sync.WaitGroup
+// Applies the pool limits of a connection to its database handle
+func applyPool(db *sql.DB, pool config.PoolConfig) {
+	if pool.MaxOpen > 0 {
+		db.SetMaxOpenConns(int(pool.MaxOpen))
+	}
+	if pool.MaxIdle > 0 {
+		db.SetMaxIdleConns(int(pool.MaxIdle))
+	}
+	if pool.MaxLifetime > 0 {
+		db.SetConnMaxLifetime(time.Duration(pool.MaxLifetime) * time.Second)
+	}
+	if pool.MaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(time.Duration(pool.MaxIdleTime) * time.Second)
+	}
+}
 
-	dm.connections = make(map[string]*Connection)
-	sem := make(chan struct{}, conf.MaxWorkers)
+// Returns the group and host limits of a connection, in acquisition order
+func limitsFor(conf *config.Config, conn *config.Connection, env *config.Environment) []limit {
+	var limits []limit
+	if size := conf.GroupLimit(conn.Group); size > 0 {
+		limits = append(limits, limit{key: "group:" + conn.Group, size: int(size)})
+	}
+	if size := conf.HostLimit(env.Host); size > 0 && env.Host != "" {
+		limits = append(limits, limit{key: "host:" + env.Host, size: int(size)})
+	}
+	return limits
+}
+
+// Takes the group and host slots of a connection. These are always taken
+// before the global worker slot, so the acquisition order is the same
+// everywhere and can't deadlock
+func (dm *Manager) acquireLimits(ctx context.Context, conn *Connection) error {
+	for i, l := range conn.limits {
+		if err := dm.limiter.Acquire(ctx, l.key, l.size); err != nil {
+			for _, taken := range conn.limits[:i] {
+				dm.limiter.Release(taken.key)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the group and host slots of a connection
+func (dm *Manager) releaseLimits(conn *Connection) {
+	for _, l := range conn.limits {
+		dm.limiter.Release(l.key)
+	}
+}
+
+// Takes a slot from the global connection budget, waiting until one is free
+func (dm *Manager) acquire(ctx context.Context) error {
+	if dm.budget == nil {
+		return nil
+	}
+
+	select {
+	case dm.budget <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns a slot to the global connection budget. The idle connections of
+// the pool are closed first, so they don't hold server connections while
+// other pools wait for a slot
+func (dm *Manager) release(conn *Connection) {
+	if dm.budget == nil {
+		return
+	}
+
+	if conn.db != nil {
+		conn.db.SetMaxIdleConns(0)
+		conn.db.SetMaxIdleConns(conn.maxIdle)
+	}
+	<-dm.budget
+}
+
+// Returns the max idle connections of a pool, 2 being the database/sql default
+func maxIdle(pool config.PoolConfig) int {
+	if pool.MaxIdle > 0 {
+		return int(pool.MaxIdle)
+	}
+	return 2
+}
+
+// Returns the lock timeout of a session, nil when neither the connection nor
+// the flags set it
+func lockTimeout(session config.SessionConfig) *time.Duration {
+	if session.LockTimeout == 0 && !session.LockTimeoutSet {
+		return nil
+	}
+	timeout := time.Duration(session.LockTimeout) * time.Millisecond
+	return &timeout
+}
+
+// Returns the query timeout of a connection, falling back to the global one
+func queryTimeout(conf *config.Config, conn *config.Connection) time.Duration {
+	if conn.QueryTimeout > 0 {
+		return time.Duration(conn.QueryTimeout) * time.Second
+	}
+	return conf.QueryTimeoutDuration
+}
+
+// Separates the entry name from the database name of a discovered
+// connection. Slashes and colons aren't allowed in sheet and file names
+const discoveredSeparator = "."
+
+// A connection to load, either configured or discovered
+type target struct {
+	conn *config.Connection
+	env  *config.Environment
+}
+
+// Opens the database handle of a connection with the driver of its engine,
+// resolving its password secret. Failures are kept in the returned
+// connection so they are reported with the run results
+func (dm *Manager) open(
+	ctx context.Context, conf *config.Config,
+	conn *config.Connection, env *config.Environment,
+) *Connection {
+	driver, err := DriverFor(conn.Engine)
+	if err != nil {
+		return &Connection{err: err}
+	}
+	// Flags take precedence over read_isolation, which takes precedence
+	// over the isolation of the connection
+	session := conf.Session.Over(env.SessionConfig)
+	isolation, err := isolationLevel(session.Isolation)
+	if err != nil {
+		return &Connection{err: err}
+	}
+	readIsolation := isolation
+	if conf.Session.Isolation == "" && conf.Transaction.ReadIsolation != "" {
+		if readIsolation, err = isolationLevel(conf.Transaction.ReadIsolation); err != nil {
+			return &Connection{err: err}
+		}
+	}
+	if len(session.Settings) > 0 && driver.SettingStatement() == "" {
+		return &Connection{err: fmt.Errorf("engine %s has no session settings", conn.Engine)}
+	}
+
+	password, err := secrets.Resolve(ctx, env.Password)
+	if err != nil {
+		return &Connection{err: err}
+	}
+	sslPassword, err := secrets.Resolve(ctx, env.SSLPassword)
+	if err != nil {
+		return &Connection{err: err}
+	}
+	resolved := *env
+	resolved.Password = password
+	resolved.SSLPassword = sslPassword
+
+	var dial DialFunc
+	if env.SSH != nil {
+		dial = dm.tunnels.dialer(env.SSH)
+	}
+	db, err := driver.Open(ctx, conf, conn, &resolved, dial)
+	if err != nil {
+		return &Connection{err: err}
+	}
+
+	pool := driver.Pool(conf.PoolFor(conn))
+	applyPool(db, pool)
 
-	for name, conn := range conf.Connections {
+	return &Connection{
+		db:            db,
+		driver:        driver,
+		queryTimeout:  queryTimeout(conf, conn),
+		isolation:     isolation,
+		readIsolation: readIsolation,
+		lockTimeout:   lockTimeout(session),
+		settings:      session.Settings,
+		maxIdle:       maxIdle(pool),
+		limits:        limitsFor(conf, conn, env),
+		retry:         NewRetryPolicy(conf.Retry),
+	}
+}
+
+// Opens a connection that isn't part of the configuration yet and pings
+// it, returning why it can't be reached
+func (dm *Manager) Test(
+	ctx context.Context, conf *config.Config, name string,
+	conn *config.Connection, env *config.Environment,
+) error {
+	c := dm.open(ctx, conf, conn, env)
+	if c.err != nil {
+		return c.err
+	}
+	defer c.db.Close()
+
+	if !c.TestConnection(ctx, name, max(conf.MaxRetries, 1)) {
+		return c.err
+	}
+	return nil
+}
+
+// Returns the connections to load in the environment, expanding the
+// discovery entries into one connection per matching database.
+// Discovery failures are stored as failed connections under the entry name
+// when the selection matches it
+func (dm *Manager) targets(
+	ctx context.Context, conf *config.Config, environment string,
+	selection *config.Selection,
+) map[string]target {
+	targets := make(map[string]target)
+
+	add := func(name string, conn *config.Connection, env *config.Environment) {
+		if !selection.Matches(name, conn) {
+			return
+		}
+		if _, exists := targets[name]; exists {
+			slog.WarnContext(ctx, locale.L.Logs.DuplicateConnectionName, "connection", name)
+			return
+		}
+		targets[name] = target{conn: conn, env: env}
+	}
+
+	// Configured connections are added before the discovered ones, so a
+	// name clash always keeps the configured connection
+	names := slices.SortedFunc(maps.Keys(conf.Connections), func(a, b string) int {
+		if discovery := conf.Connections[a].IsDiscovery(); discovery != conf.Connections[b].IsDiscovery() {
+			if discovery {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a, b)
+	})
+
+	for _, name := range names {
+		conn := conf.Connections[name]
 		env := conn.Environment[environment]
 		if env == nil {
 			continue
@@ -56,38 +292,123 @@ func (dm *Manager) LoadConnections(ctx context.Context, conf *config.Config, env
 			continue
 		}
 
-		switch conn.Engine {
-		case "postgres", "postgresql":
-			dsn := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s connect_timeout=%d sslmode=%s",
-				env.Host, env.Port, env.Database, env.Username, env.Password, conf.Timeout,
-				conn.SSLMode,
-			)
-			db, err := sql.Open("pgx", dsn)
-			if err != nil {
-				dm.connections[name] = &Connection{
-					err: fmt.Errorf("unable to connect to %s: %w", conn.Host, err),
-				}
-			} else {
-				dm.connections[name] = &Connection{db: db}
-			}
+		if !conn.IsDiscovery() {
+			add(name, conn, env)
+			continue
 		}
 
-		if len(connections) > 0 && !slices.Contains(connections, name) {
+		databases, err := dm.discover(ctx, conf, name, conn, env)
+		if err != nil {
+			slog.ErrorContext(ctx, locale.L.Logs.DiscoveryFailed, "connection", name, "error", err)
+			if selection.Matches(name, conn) {
+				dm.connections[name] = &Connection{err: fmt.Errorf("discovery on %s failed: %w", env.Host, err)}
+			}
 			continue
 		}
+		slog.InfoContext(ctx, locale.L.Logs.DatabasesDiscovered, "connection", name, "databases", len(databases))
+
+		// Named after the entry too, as servers often share database names
+		for _, database := range databases {
+			discovered, discoveredEnv := conn.ForDatabase(env, database)
+			add(name+discoveredSeparator+database, discovered, discoveredEnv)
+		}
+	}
+
+	return targets
+}
+
+// Lists the databases of a discovery entry's server, either with its
+// discovery query or by matching the server catalog against its pattern
+func (dm *Manager) discover(
+	ctx context.Context, conf *config.Config, name string,
+	conn *config.Connection, env *config.Environment,
+) ([]string, error) {
+	server := dm.open(ctx, conf, conn, env)
+	if server.err != nil {
+		return nil, server.err
+	}
+	defer server.db.Close()
+
+	query := conn.DiscoverQuery
+	if query == "" {
+		query = server.driver.DatabasesQuery()
+	}
+	if query == "" {
+		return nil, fmt.Errorf("engine %s has no databases to discover", conn.Engine)
+	}
+
+	rows, err := server.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var databases []string
+	for rows.Next() {
+		var database string
+		if err := rows.Scan(&database); err != nil {
+			return nil, err
+		}
+
+		if conn.Discover != "" {
+			matched, err := path.Match(conn.Discover, database)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+		}
+		databases = append(databases, database)
+	}
+
+	return databases, rows.Err()
+}
+
+// Loads the database connections from the configuration
+// Only the connections matched by selection are loaded
+func (dm *Manager) LoadConnections(
+	ctx context.Context, conf *config.Config, environment string,
+	selection *config.Selection,
+) {
+	var wg sync.WaitGroup
+
+	dm.connections = make(map[string]*Connection)
+	sem := make(chan struct{}, conf.MaxWorkers)
+	if conf.MaxConnections > 0 {
+		dm.budget = make(chan struct{}, conf.MaxConnections)
+	}
+
+	for name, t := range dm.targets(ctx, conf, environment, selection) {
+		conn := dm.open(ctx, conf, t.conn, t.env)
+		dm.connections[name] = conn
 
 		wg.Add(1)
 
-		go func(name string) {
+		go func(name string, conn *Connection) {
+			defer wg.Done()
+
+			if conn.db == nil {
+				return
+			}
+
+			if err := dm.acquireLimits(ctx, conn); err != nil {
+				conn.err = classifyError(ctx, name, err)
+				return
+			}
+			defer dm.releaseLimits(conn)
+
 			sem <- struct{}{}
-			defer func() {
-				<-sem
-				wg.Done()
-			}()
+			defer func() { <-sem }()
 
-			dm.connections[name].TestConnection(ctx, name, conf.MaxRetries)
-		}(name)
+			if err := dm.acquire(ctx); err != nil {
+				conn.err = classifyError(ctx, name, err)
+				return
+			}
+			defer dm.release(conn)
 
+			conn.TestConnection(ctx, name, conf.MaxRetries)
+		}(name, conn)
 	}
 	wg.Wait()
 	close(sem)
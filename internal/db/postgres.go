@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+
+	"ohnitiel/prismatic/internal/config"
+	sqlparser "ohnitiel/prismatic/internal/db/sql"
+)
+
+// PostgresDriver connects to PostgreSQL servers through pgx
+type PostgresDriver struct{}
+
+func (PostgresDriver) Open(
+	ctx context.Context, conf *config.Config, conn *config.Connection,
+	env *config.Environment, dial DialFunc,
+) (*sql.DB, error) {
+	connConfig, err := postgresConfig(conf, conn, env)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", env.Host, err)
+	}
+	if dial != nil {
+		// The tunnel resolves the host on the far side
+		connConfig.LookupFunc = func(ctx context.Context, host string) ([]string, error) {
+			return []string{host}, nil
+		}
+		connConfig.DialFunc = pgconn.DialFunc(dial)
+	}
+
+	return stdlib.OpenDB(*connConfig), nil
+}
+
+func (PostgresDriver) Pool(pool config.PoolConfig) config.PoolConfig {
+	return pool
+}
+
+func (PostgresDriver) Ping(ctx context.Context, db *sql.DB) error {
+	return db.PingContext(ctx)
+}
+
+func (PostgresDriver) Classify(query string) (sqlparser.QueryType, bool) {
+	switch leadingKeyword(query) {
+	case "SHOW":
+		return sqlparser.DQL, true
+	case "TRUNCATE":
+		return sqlparser.DML, true
+	case "ALTER", "COMMENT", "GRANT", "REVOKE":
+		return sqlparser.DDL, true
+	}
+	return 0, false
+}
+
+func (PostgresDriver) DatabasesQuery() string {
+	return "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname"
+}
+
+func (PostgresDriver) TimeoutStatement(timeout time.Duration) string {
+	return fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout.Milliseconds())
+}
+
+func (PostgresDriver) LockTimeoutStatement(timeout time.Duration) string {
+	return fmt.Sprintf("SET LOCAL lock_timeout = %d", timeout.Milliseconds())
+}
+
+// Same as SET LOCAL, which can't take the value as a parameter
+func (PostgresDriver) SettingStatement() string {
+	return "SELECT set_config($1, $2, true)"
+}
+
+func (PostgresDriver) ReadOnlyStatements() (string, string) {
+	return "", ""
+}
+
+func (PostgresDriver) TryLockStatement() string {
+	return "SELECT pg_try_advisory_xact_lock($1)"
+}
+
+// Needs max_prepared_transactions above zero on the server
+func (PostgresDriver) TwoPhaseStatements(id string) (string, string, string, bool) {
+	quoted := "'" + strings.ReplaceAll(id, "'", "''") + "'"
+	return "PREPARE TRANSACTION " + quoted, "COMMIT PREPARED " + quoted, "ROLLBACK PREPARED " + quoted, true
+}
+
+// Without a server error, the commit may or may not have been applied
+func (PostgresDriver) CommitUncertain(err error) bool {
+	var pgErr *pgconn.PgError
+	return !errors.As(err, &pgErr)
+}
+
+func (PostgresDriver) TLSState(ctx context.Context, db *sql.DB) (*tls.ConnectionState, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var state *tls.ConnectionState
+	err = conn.Raw(func(driverConn any) error {
+		pgxConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("unsupported driver connection %T", driverConn)
+		}
+
+		if tlsConn, ok := pgxConn.Conn().PgConn().Conn().(*tls.Conn); ok {
+			s := tlsConn.ConnectionState()
+			state = &s
+		}
+		return nil
+	})
+
+	return state, err
+}
+
+func (PostgresDriver) Local() bool {
+	return false
+}
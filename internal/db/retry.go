@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/locale"
+)
+
+// SQLSTATE codes and classes retried when none are configured:
+// serialization failure, deadlock, admin shutdown and connection exceptions
+var defaultRetryable = []string{"40001", "40P01", "57P01", "08"}
+
+// Returned (wrapped) when a commit failed without a server response, so it
+// is unknown whether the transaction was applied. These are never retried
+var errCommitUncertain = errors.New("commit outcome unknown")
+
+// RetryPolicy decides which query failures are retried and how long to wait
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Budget         time.Duration
+	Retryable      []string
+}
+
+func NewRetryPolicy(conf config.RetryConfig) RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts:    max(int(conf.MaxAttempts), 1),
+		InitialBackoff: time.Duration(conf.InitialBackoff) * time.Millisecond,
+		MaxBackoff:     time.Duration(conf.MaxBackoff) * time.Millisecond,
+		Budget:         time.Duration(conf.Budget) * time.Second,
+		Retryable:      conf.Retryable,
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = defaultRetryable
+	}
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = 500 * time.Millisecond
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = 10 * time.Second
+	}
+
+	return policy
+}
+
+// Reports whether err is worth another attempt: a configured SQLSTATE code
+// or class, or a connection reset. Timeouts, cancellations, busy locks and
+// uncertain commits are never retried
+func (p RetryPolicy) IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, ErrQueryTimeout) || errors.Is(err, ErrCancelled) ||
+		errors.Is(err, ErrBusy) || errors.Is(err, errCommitUncertain) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return slices.ContainsFunc(p.Retryable, func(code string) bool {
+			return strings.HasPrefix(pgErr.Code, code)
+		})
+	}
+
+	return errors.Is(err, driver.ErrBadConn) ||
+		isSQLiteBusy(err) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		pgconn.SafeToRetry(err)
+}
+
+// Returns the wait before the given retry attempt (starting at 1), growing
+// exponentially up to MaxBackoff, with full jitter
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff << min(attempt-1, 30)
+	if backoff <= 0 || backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	return rand.N(backoff) + 1
+}
+
+// Runs fn until it succeeds, fails with a non retryable error, runs out of
+// attempts or would exceed the total budget.
+// Returns the number of retries made
+func (p RetryPolicy) Do(ctx context.Context, name string, fn func() error) (int, error) {
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !p.IsRetryable(err) {
+			return attempt - 1, err
+		}
+
+		wait := p.Backoff(attempt)
+		if p.Budget > 0 && time.Since(start)+wait > p.Budget {
+			slog.WarnContext(ctx, locale.L.Logs.RetryBudgetExhausted, "connection", name, "attempt", attempt, "error", err)
+			return attempt - 1, err
+		}
+
+		slog.WarnContext(ctx, locale.L.Logs.RetryingQuery,
+			"connection", name,
+			"attempt", attempt,
+			"max_attempts", p.MaxAttempts,
+			"backoff", wait,
+			"error", err,
+		)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return attempt - 1, classifyError(ctx, name, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/locale"
+)
+
+func TestRetryPolicyIsRetryable(t *testing.T) {
+	policy := NewRetryPolicy(config.RetryConfig{})
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, true},
+		{"deadlock", fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "40P01"}), true},
+		{"connection exception class", &pgconn.PgError{Code: "08006"}, true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"bad connection", driver.ErrBadConn, true},
+		{"timeout", fmt.Errorf("%w: %w", ErrQueryTimeout, context.DeadlineExceeded), false},
+		{"uncertain commit", fmt.Errorf("%w: %w", errCommitUncertain, driver.ErrBadConn), false},
+		{"generic", errors.New("syntax error"), false},
+	}
+
+	for _, tt := range tests {
+		if got := policy.IsRetryable(tt.err); got != tt.want {
+			t.Errorf("%s: IsRetryable() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := NewRetryPolicy(config.RetryConfig{InitialBackoff: 100, MaxBackoff: 1000})
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		backoff := policy.Backoff(attempt)
+		if backoff <= 0 || backoff > time.Second {
+			t.Errorf("Backoff(%d) = %v, want within (0, 1s]", attempt, backoff)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	locale.L = &locale.Locale{}
+	policy := NewRetryPolicy(config.RetryConfig{MaxAttempts: 3, InitialBackoff: 1, MaxBackoff: 1})
+
+	calls := 0
+	retries, err := policy.Do(context.Background(), "conn", func() error {
+		calls++
+		if calls < 3 {
+			return &pgconn.PgError{Code: "40001"}
+		}
+		return nil
+	})
+	if err != nil || retries != 2 {
+		t.Errorf("Do() = (%d, %v), want (2, nil)", retries, err)
+	}
+
+	calls = 0
+	retries, err = policy.Do(context.Background(), "conn", func() error {
+		calls++
+		return &pgconn.PgError{Code: "23505"}
+	})
+	if err == nil || retries != 0 || calls != 1 {
+		t.Errorf("Do() on non retryable error = (%d, %v) after %d calls, want one failed call", retries, err, calls)
+	}
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ohnitiel/prismatic/internal/config"
+	sqlparser "ohnitiel/prismatic/internal/db/sql"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Time a statement waits for a lock held by another process before failing
+// with SQLITE_BUSY, in milliseconds
+const sqliteBusyTimeout = 5000
+
+// SQLiteDriver opens local SQLite database files
+type SQLiteDriver struct{}
+
+// Opens the database file of a SQLite connection. Relative paths are
+// resolved from the connections file. The file must exist, so a typo doesn't
+// create an empty database
+func (SQLiteDriver) Open(
+	ctx context.Context, conf *config.Config, conn *config.Connection,
+	env *config.Environment, dial DialFunc,
+) (*sql.DB, error) {
+	path := env.Database
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(conf.Paths.Connections), path)
+	}
+
+	query := url.Values{}
+	query.Set("mode", "rw")
+	query.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout))
+	query.Add("_pragma", "foreign_keys(1)")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", env.Database, err)
+	}
+	return db, nil
+}
+
+// Writers on the same file would only wait on each other's locks, so pools
+// default to a single connection
+func (SQLiteDriver) Pool(pool config.PoolConfig) config.PoolConfig {
+	if pool.MaxOpen == 0 {
+		pool.MaxOpen = 1
+	}
+	return pool
+}
+
+// Reads the schema too, as opening a file that isn't a database succeeds
+func (SQLiteDriver) Ping(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "SELECT count(*) FROM sqlite_master")
+	return err
+}
+
+func (SQLiteDriver) Classify(query string) (sqlparser.QueryType, bool) {
+	switch leadingKeyword(query) {
+	case "PRAGMA":
+		if strings.Contains(query, "=") {
+			return sqlparser.DDL, true
+		}
+		return sqlparser.DQL, true
+	case "VACUUM", "REINDEX", "ANALYZE", "ATTACH", "DETACH", "ALTER":
+		return sqlparser.DDL, true
+	}
+	return 0, false
+}
+
+func (SQLiteDriver) DatabasesQuery() string {
+	return ""
+}
+
+func (SQLiteDriver) TimeoutStatement(timeout time.Duration) string {
+	return ""
+}
+
+// Lock waits are bounded by the busy timeout of the connection
+func (SQLiteDriver) LockTimeoutStatement(timeout time.Duration) string {
+	return ""
+}
+
+func (SQLiteDriver) SettingStatement() string {
+	return ""
+}
+
+// SQLite ignores the read-only option of BeginTx. query_only outlives the
+// transaction, so it is reset before the connection returns to the pool
+func (SQLiteDriver) ReadOnlyStatements() (string, string) {
+	return "PRAGMA query_only = ON", "PRAGMA query_only = OFF"
+}
+
+func (SQLiteDriver) TryLockStatement() string {
+	return ""
+}
+
+func (SQLiteDriver) TwoPhaseStatements(id string) (string, string, string, bool) {
+	return "", "", "", false
+}
+
+// The commit of a local file either fails or is applied
+func (SQLiteDriver) CommitUncertain(err error) bool {
+	return false
+}
+
+func (SQLiteDriver) TLSState(ctx context.Context, db *sql.DB) (*tls.ConnectionState, error) {
+	return nil, db.PingContext(ctx)
+}
+
+func (SQLiteDriver) Local() bool {
+	return true
+}
+
+// Reports whether err is a SQLite lock conflict, worth another attempt
+func isSQLiteBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	code := sqliteErr.Code() & 0xff // Extended codes keep the primary one in the low byte
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
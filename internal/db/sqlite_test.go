@@ -0,0 +1,155 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/locale"
+)
+
+// Creates a site database holding a single item
+func createSite(t *testing.T, path string, item string) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, stmt := range []string{
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT NOT NULL)",
+		"INSERT INTO items (name) VALUES ('" + item + "')",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Runs export and run end to end on SQLite files, as on any other engine
+func TestSQLiteEndToEnd(t *testing.T) {
+	locale.L = &locale.Locale{}
+	dir := t.TempDir()
+	createSite(t, filepath.Join(dir, "site_a.db"), "apple")
+	createSite(t, filepath.Join(dir, "site_b.db"), "banana")
+
+	conf := &config.Config{
+		MaxWorkers: 2,
+		MaxRetries: 1,
+		Paths:      config.PathConfigs{Connections: filepath.Join(dir, "connections.toml")},
+		Connections: map[string]*config.Connection{
+			"site_a":  {Engine: "sqlite", Database: "site_a.db"},
+			"site_b":  {Engine: "sqlite", Database: filepath.Join(dir, "site_b.db")},
+			"missing": {Engine: "sqlite", Database: "missing.db"},
+			"oracle":  {Engine: "oracle", Host: "10.0.0.10"},
+		},
+	}
+	for _, conn := range conf.Connections {
+		conn.Environment = map[string]*config.Environment{"production": {Host: conn.Host}}
+		conn.Resolve(conn.Environment["production"])
+	}
+
+	ctx := context.Background()
+	manager := NewDatabaseManager()
+	defer manager.Close()
+	manager.LoadConnections(ctx, conf, "production", nil)
+	executor := NewExecutor(manager)
+
+	results, failures := executor.ParallelExecution(ctx, conf.MaxWorkers,
+		"SELECT name FROM items ORDER BY id", false, false, conf, "export")
+	if _, ok := failures["missing"]; !ok || failures["oracle"] == nil || len(failures) != 2 {
+		t.Errorf("failures = %v, want the missing file and the unsupported engine", failures)
+	}
+	for name, want := range map[string]string{"site_a": "apple", "site_b": "banana"} {
+		if res := results[name]; res == nil || !reflect.DeepEqual(res.Rows, [][]any{{want}}) {
+			t.Errorf("results[%s] = %+v, want %s", name, res, want)
+		}
+	}
+
+	update := "UPDATE items SET name = upper(name)"
+	if _, failures := executor.ParallelExecution(ctx, conf.MaxWorkers, update, false, false, conf, "run"); len(failures) != 2 {
+		t.Errorf("dry run failures = %v", failures)
+	}
+	if got := executor.Committed(); len(got) != 0 {
+		t.Errorf("Committed() = %v after a dry run", got)
+	}
+	results, _ = executor.ParallelExecution(ctx, conf.MaxWorkers, "SELECT name FROM items", false, false, conf, "export")
+	if got := results["site_a"].Rows[0][0]; got != "apple" {
+		t.Errorf("site_a item = %v, want the dry run rolled back", got)
+	}
+
+	// Exports are read-only even when asked to commit, and the pooled
+	// connection is writable again afterwards
+	if _, failures := executor.ParallelExecution(ctx, conf.MaxWorkers, update, false, true, conf, "export"); failures["site_a"] == nil {
+		t.Errorf("export failures = %v, want the update rejected", failures)
+	}
+
+	// Writes mentioning SELECT, which the classifier takes for reads, still
+	// run in a writable transaction
+	insert := "INSERT INTO items (name) SELECT 'cherry'"
+	if _, failures := executor.ParallelExecution(ctx, conf.MaxWorkers, insert, false, false, conf, "run"); failures["site_a"] != nil {
+		t.Errorf("run failures = %v, want the insert to run", failures)
+	}
+
+	executor.ParallelExecution(ctx, conf.MaxWorkers, update, false, true, conf, "run")
+	if got, want := executor.Committed(), []string{"site_a", "site_b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Committed() = %v, want %v", got, want)
+	}
+	results, _ = executor.ParallelExecution(ctx, conf.MaxWorkers, "SELECT name FROM items", false, false, conf, "export")
+	if got := results["site_b"].Rows[0][0]; got != "BANANA" {
+		t.Errorf("site_b item = %v, want the update committed", got)
+	}
+}
+
+// Runs whose deadline passed are reported as timed out, apart from the
+// failed and cancelled ones
+func TestSQLiteQueryTimeout(t *testing.T) {
+	locale.L = &locale.Locale{}
+	dir := t.TempDir()
+	createSite(t, filepath.Join(dir, "site.db"), "apple")
+
+	conf := config.NewConfig()
+	conf.MaxWorkers, conf.MaxRetries = 1, 1
+	conf.Paths.Connections = filepath.Join(dir, "connections.toml")
+	conf.Connections = map[string]*config.Connection{
+		"site": {Engine: "sqlite", Environment: map[string]*config.Environment{
+			"production": {Database: "site.db"},
+		}},
+	}
+
+	manager := NewDatabaseManager()
+	defer manager.Close()
+	manager.LoadConnections(context.Background(), conf, "production", nil)
+	executor := NewExecutor(manager)
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, failures := executor.ParallelExecution(expired, conf.MaxWorkers, "SELECT name FROM items", false, false, conf, "export")
+	if !errors.Is(failures["site"], ErrQueryTimeout) {
+		t.Errorf("failures = %v, want a query timeout", failures)
+	}
+	if summary := NewSummary(0, failures); summary.TimedOut != 1 || summary.Failed != 0 || summary.Cancelled != 0 {
+		t.Errorf("NewSummary() = %+v, want one timed out connection", summary)
+	}
+
+	err := manager.GetConnection("site").WithTransaction(expired, "site", false, nil,
+		func(ctx context.Context, tx *sql.Tx) error { return nil })
+	if !errors.Is(err, ErrQueryTimeout) {
+		t.Errorf("WithTransaction() error = %v, want a query timeout", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, failures = executor.ParallelExecution(cancelled, conf.MaxWorkers, "SELECT name FROM items", false, false, conf, "export")
+	if summary := NewSummary(0, failures); summary.Cancelled != 1 || summary.TimedOut != 0 {
+		t.Errorf("NewSummary() = %+v, want one cancelled connection", summary)
+	}
+}
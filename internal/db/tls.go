@@ -0,0 +1,23 @@
+package db
+
+import (
+	"context"
+	"crypto/tls"
+)
+
+// Returns the TLS session negotiated by a connection of the pool,
+// nil when the connection isn't encrypted
+func (c *Connection) TLSState(ctx context.Context) (*tls.ConnectionState, error) {
+	return c.driver.TLSState(ctx, c.db)
+}
+
+// Applies the TLS settings that have no libpq parameter to the TLS
+// configurations pgx derived from the connection string
+func applyTLS(tlsConfig *tls.Config, serverName string) {
+	if tlsConfig == nil {
+		return
+	}
+	if serverName != "" {
+		tlsConfig.ServerName = serverName
+	}
+}
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"ohnitiel/prismatic/internal/config"
+)
+
+const defaultSSHPort = 22
+
+// SSH clients shared by the connections of a manager, keyed by the chain of
+// hosts they go through, so every database behind a bastion uses one tunnel
+type tunnels struct {
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+	// Closed with the tunnels, e.g. the SSH agent connection
+	closers []func() error
+}
+
+func newTunnels() *tunnels {
+	return &tunnels{clients: make(map[string]*ssh.Client)}
+}
+
+// A host of the tunnel chain
+type hop struct {
+	user string
+	addr string
+}
+
+// Returns the hosts to go through, jump hosts first and the bastion last
+func sshHops(conf *config.SSHConfig) ([]hop, error) {
+	hops := make([]hop, 0, len(conf.Jump)+1)
+	for _, jump := range conf.Jump {
+		user, host := conf.User, jump
+		if at := strings.LastIndex(jump, "@"); at >= 0 {
+			user, host = jump[:at], jump[at+1:]
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, strconv.Itoa(defaultSSHPort))
+		}
+		if host == "" || user == "" {
+			return nil, fmt.Errorf("invalid jump host %s", jump)
+		}
+		hops = append(hops, hop{user: user, addr: host})
+	}
+
+	port := conf.Port
+	if port == 0 {
+		port = defaultSSHPort
+	}
+	hops = append(hops, hop{user: conf.User, addr: net.JoinHostPort(conf.Host, strconv.Itoa(int(port)))})
+
+	return hops, nil
+}
+
+// Returns a dialer routing the connections through the SSH tunnel. Host
+// names are resolved by the bastion, as they usually are only known behind it
+func (t *tunnels) dialer(conf *config.SSHConfig) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, err := t.client(ctx, conf)
+		if err != nil {
+			return nil, fmt.Errorf("ssh tunnel through %s: %w", conf.Host, err)
+		}
+		return client.DialContext(ctx, network, addr)
+	}
+}
+
+// Returns the client of the bastion, connecting on first use
+func (t *tunnels) client(ctx context.Context, conf *config.SSHConfig) (*ssh.Client, error) {
+	hops, err := sshHops(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tunnels are opened one at a time, so concurrent connections behind
+	// the same bastion wait for its tunnel instead of opening their own
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var client *ssh.Client
+	var clientConfig *ssh.ClientConfig
+	key := conf.KeyFile
+	for _, h := range hops {
+		key += "|" + h.user + "@" + h.addr
+		if cached, ok := t.clients[key]; ok {
+			client = cached
+			continue
+		}
+
+		if clientConfig == nil {
+			if clientConfig, err = t.clientConfig(conf); err != nil {
+				return nil, err
+			}
+		}
+		hopConfig := *clientConfig
+		hopConfig.User = h.user
+
+		client, err = connectHop(ctx, client, h, &hopConfig)
+		if err != nil {
+			return nil, err
+		}
+		t.clients[key] = client
+		go t.forget(key, client)
+	}
+
+	return client, nil
+}
+
+// Connects to a host, directly or through the previous hop
+func connectHop(ctx context.Context, through *ssh.Client, h hop, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if through == nil {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", h.addr)
+	} else {
+		conn, err = through.DialContext(ctx, "tcp", h.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake has no context, so its deadline is set on the connection
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, h.addr, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// Removes a client once its connection is lost, so the next connection
+// opens a new tunnel
+func (t *tunnels) forget(key string, client *ssh.Client) {
+	client.Wait()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clients[key] == client {
+		delete(t.clients, key)
+	}
+}
+
+// Returns the client settings of the tunnel. Must be called with the lock held
+func (t *tunnels) clientConfig(conf *config.SSHConfig) (*ssh.ClientConfig, error) {
+	auth, err := t.auth(conf)
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownHosts(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{Auth: auth, HostKeyCallback: hostKeys}, nil
+}
+
+// Returns the authentication methods of the tunnel, using the key file
+// when set and the SSH agent otherwise
+func (t *tunnels) auth(conf *config.SSHConfig) ([]ssh.AuthMethod, error) {
+	if conf.KeyFile != "" {
+		key, err := os.ReadFile(expandHome(conf.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", conf.KeyFile, err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("no key_file set for %s and no SSH agent running", conf.Host)
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	t.closers = append(t.closers, conn.Close)
+
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, nil
+}
+
+// Returns the host key verification of the tunnel. Unknown hosts are
+// always rejected
+func knownHosts(conf *config.SSHConfig) (ssh.HostKeyCallback, error) {
+	path := conf.KnownHosts
+	if path == "" {
+		path = "~/.ssh/known_hosts"
+	}
+	return knownhosts.New(expandHome(path))
+}
+
+// Expands a leading ~ to the home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// Closes every tunnel
+func (t *tunnels) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, client := range t.clients {
+		client.Close()
+		delete(t.clients, key)
+	}
+	for _, closer := range t.closers {
+		closer()
+	}
+	t.closers = nil
+}
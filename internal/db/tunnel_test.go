@@ -0,0 +1,261 @@
+package db
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"ohnitiel/prismatic/internal/config"
+)
+
+// In-process SSH server forwarding direct-tcpip channels, counting the
+// SSH connections it accepts
+type testSSHServer struct {
+	addr        string
+	hostKey     ssh.PublicKey
+	connections atomic.Int32
+}
+
+func startSSHServer(t *testing.T, authorized ssh.PublicKey) *testSSHServer {
+	t.Helper()
+
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(authorized.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testSSHServer{addr: listener.Addr().String(), hostKey: hostSigner.PublicKey()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, serverConfig)
+		}
+	}()
+
+	return server
+}
+
+func (s *testSSHServer) serve(conn net.Conn, serverConfig *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	s.connections.Add(1)
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &target) != nil {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+
+		remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelReqs, err := newChannel.Accept()
+		if err != nil {
+			remote.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelReqs)
+		go func() {
+			io.Copy(channel, remote)
+			channel.Close()
+		}()
+		go func() {
+			io.Copy(remote, channel)
+			remote.Close()
+		}()
+	}
+}
+
+// Starts a TCP echo server standing in for a database behind the bastion
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// Writes the client key and an empty known_hosts file, returning the tunnel
+// settings and the public key to authorize
+func sshTestConfig(t *testing.T) (*config.SSHConfig, ssh.PublicKey) {
+	t.Helper()
+	dir := t.TempDir()
+
+	clientPub, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHostsFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &config.SSHConfig{User: "prismatic", KeyFile: keyFile, KnownHosts: knownHostsFile}, publicKey
+}
+
+func sshTarget(t *testing.T, conf *config.SSHConfig, server *testSSHServer) {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(server.addr)
+	portNumber, _ := strconv.Atoi(port)
+	conf.Host, conf.Port = host, uint16(portNumber)
+}
+
+func assertEcho(t *testing.T, tun *tunnels, conf *config.SSHConfig, addr string) {
+	t.Helper()
+
+	client, err := tun.client(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("client() error = %v", err)
+	}
+	conn, err := client.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("echo through tunnel = %q, %v", reply, err)
+	}
+}
+
+func TestTunnelSharedPerBastion(t *testing.T) {
+	echo := startEchoServer(t)
+
+	conf, clientKey := sshTestConfig(t)
+	server := startSSHServer(t, clientKey)
+	trustHosts(t, conf, server)
+	sshTarget(t, conf, server)
+
+	tun := newTunnels()
+	defer tun.close()
+
+	assertEcho(t, tun, conf, echo)
+	assertEcho(t, tun, conf, echo)
+
+	if got := server.connections.Load(); got != 1 {
+		t.Errorf("SSH connections = %d, want one shared tunnel", got)
+	}
+}
+
+func TestTunnelThroughJumpHost(t *testing.T) {
+	echo := startEchoServer(t)
+
+	conf, clientKey := sshTestConfig(t)
+	jump := startSSHServer(t, clientKey)
+	bastion := startSSHServer(t, clientKey)
+	trustHosts(t, conf, jump, bastion)
+	sshTarget(t, conf, bastion)
+	conf.Jump = []string{"jumper@" + jump.addr}
+
+	tun := newTunnels()
+	defer tun.close()
+
+	assertEcho(t, tun, conf, echo)
+
+	if jump.connections.Load() != 1 || bastion.connections.Load() != 1 {
+		t.Errorf("connections: jump = %d, bastion = %d, want 1 each",
+			jump.connections.Load(), bastion.connections.Load())
+	}
+}
+
+func TestTunnelRejectsUnknownHost(t *testing.T) {
+	conf, clientKey := sshTestConfig(t)
+	server := startSSHServer(t, clientKey)
+	sshTarget(t, conf, server)
+
+	tun := newTunnels()
+	defer tun.close()
+
+	if _, err := tun.client(context.Background(), conf); err == nil {
+		t.Fatal("client() should fail when the host key isn't in known_hosts")
+	}
+}
+
+// Trusts the host keys of the servers in the known_hosts file of the settings
+func trustHosts(t *testing.T, conf *config.SSHConfig, servers ...*testSSHServer) {
+	t.Helper()
+
+	var lines string
+	for _, server := range servers {
+		lines += knownhosts.Line([]string{knownhosts.Normalize(server.addr)}, server.hostKey) + "\n"
+	}
+	if err := os.WriteFile(conf.KnownHosts, []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,8 +2,8 @@ package locale
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -18,22 +18,89 @@ type CliFlags struct {
 	NoSingleSheet string `toml:"no_single_sheet"`
 	NoSingleFile  string `toml:"no_single_file"`
 	Commit        string `toml:"commit"`
+	ReadOnly      string `toml:"read_only"`
+	Isolation     string `toml:"isolation"`
+	LockTimeout   string `toml:"lock_timeout"`
+	Set           string `toml:"set"`
+	NoLock        string `toml:"no_lock"`
+	LockName      string `toml:"lock_name"`
+	Steps         string `toml:"steps"`
+	QueryTimeout  string `toml:"query_timeout"`
+	RunTimeout    string `toml:"run_timeout"`
+	WholeFile     string `toml:"whole_file"`
+	KeyFile       string `toml:"key_file"`
+	Format        string `toml:"format"`
+	ImportFormat  string `toml:"import_format"`
+	EnvMap        string `toml:"env_map"`
+	DryRun        string `toml:"dry_run"`
+	SecretStore   string `toml:"secret_store"`
+	User          string `toml:"user"`
+	Profile       string `toml:"profile"`
+	Effective     string `toml:"effective"`
 }
 
 type CliCommands struct {
-	Export        string `toml:"export"`
-	Run           string `toml:"run"`
-	Check         string `toml:"check"`
-	Config        string `toml:"config"`
-	ConfigInstall string `toml:"config_install"`
-	ConfigShow    string `toml:"config_show"`
-	ConfigEdit    string `toml:"config_edit"`
+	Export              string `toml:"export"`
+	Run                 string `toml:"run"`
+	Check               string `toml:"check"`
+	Config              string `toml:"config"`
+	ConfigInstall       string `toml:"config_install"`
+	ConfigShow          string `toml:"config_show"`
+	ConfigEdit          string `toml:"config_edit"`
+	Migrate             string `toml:"migrate"`
+	MigrateUp           string `toml:"migrate_up"`
+	MigrateDown         string `toml:"migrate_down"`
+	MigrateStatus       string `toml:"migrate_status"`
+	ConfigEncrypt       string `toml:"config_encrypt"`
+	ConfigDecrypt       string `toml:"config_decrypt"`
+	ConfigValidate      string `toml:"config_validate"`
+	ConfigSet           string `toml:"config_set"`
+	ConfigAddConnection string `toml:"config_add_connection"`
+	ConfigImport        string `toml:"config_import"`
 }
 
 type CliArgs struct {
-	Export     string `toml:"export"`
-	Run        string `toml:"run"`
-	ConfigShow string `toml:"config_show"`
+	Export       string `toml:"export"`
+	Run          string `toml:"run"`
+	ConfigShow   string `toml:"config_show"`
+	ConfigSet    string `toml:"config_set"`
+	ConfigEdit   string `toml:"config_edit"`
+	ConfigImport string `toml:"config_import"`
+	Migrate      string `toml:"migrate"`
+}
+
+type CliMigrationStatus struct {
+	Connection string `toml:"connection"`
+	Applied    string `toml:"applied"`
+	Pending    string `toml:"pending"`
+	Error      string `toml:"error"`
+}
+
+type CliCheckStatus struct {
+	Connection   string `toml:"connection"`
+	TLSVersion   string `toml:"tls_version"`
+	Cipher       string `toml:"cipher"`
+	NotEncrypted string `toml:"not_encrypted"`
+	Error        string `toml:"error"`
+}
+
+type CliPrompts struct {
+	Name            string `toml:"name"`
+	Engine          string `toml:"engine"`
+	Database        string `toml:"database"`
+	Username        string `toml:"username"`
+	Password        string `toml:"password"`
+	Environments    string `toml:"environments"`
+	Host            string `toml:"host"`
+	Port            string `toml:"port"`
+	File            string `toml:"file"`
+	SSLMode         string `toml:"sslmode"`
+	SecretStore     string `toml:"secret_store"`
+	Required        string `toml:"required"`
+	Invalid         string `toml:"invalid"`
+	ConnectionOK    string `toml:"connection_ok"`
+	ConnectionError string `toml:"connection_error"`
+	SaveAnyway      string `toml:"save_anyway"`
 }
 
 type CliSection struct {
@@ -41,6 +108,10 @@ type CliSection struct {
 	Flags       CliFlags    `toml:"flags"`
 	Commands    CliCommands `toml:"commands"`
 	Args        CliArgs     `toml:"args"`
+
+	MigrationStatus CliMigrationStatus `toml:"migration_status"`
+	CheckStatus     CliCheckStatus     `toml:"check_status"`
+	Prompts         CliPrompts         `toml:"prompts"`
 }
 
 type ErrorsSection struct {
@@ -52,13 +123,58 @@ type ErrorsSection struct {
 	ContextDeadline     string `toml:"context_deadline"`
 	NoDataReturned      string `toml:"no_data_returned"`
 	QueryIsDirectory    string `toml:"query_is_directory"`
+
+	InvalidMigrationFile      string `toml:"invalid_migration_file"`
+	DuplicateMigrationVersion string `toml:"duplicate_migration_version"`
+	MissingDownMigration      string `toml:"missing_down_migration"`
+	MissingUpMigration        string `toml:"missing_up_migration"`
+	UnknownAppliedMigration   string `toml:"unknown_applied_migration"`
+	UnknownSelection          string `toml:"unknown_selection"`
+	InvalidSelection          string `toml:"invalid_selection"`
+	NoConnectionsSelected     string `toml:"no_connections_selected"`
+
+	UnknownKey           string `toml:"unknown_key"`
+	InvalidValue         string `toml:"invalid_value"`
+	MissingField         string `toml:"missing_field"`
+	UnsupportedEngine    string `toml:"unsupported_engine"`
+	DuplicateTarget      string `toml:"duplicate_target"`
+	UnresolvedVariable   string `toml:"unresolved_variable"`
+	InvalidLogLevel      string `toml:"invalid_log_level"`
+	InvalidIsolation     string `toml:"invalid_isolation"`
+	InvalidSetting       string `toml:"invalid_setting"`
+	InvalidSteps         string `toml:"invalid_steps"`
+	UnknownSecretStore   string `toml:"unknown_secret_store"`
+	InvalidConsoleOutput string `toml:"invalid_console_output"`
+
+	ConnectionsFileEncrypted string `toml:"connections_file_encrypted"`
+	NotAValue                string `toml:"not_a_value"`
+	MultilineValue           string `toml:"multiline_value"`
+	UnknownConfigFile        string `toml:"unknown_config_file"`
+	ConnectionExists         string `toml:"connection_exists"`
+
+	UnknownImportFormat string `toml:"unknown_import_format"`
+	DuplicateImport     string `toml:"duplicate_import"`
+	InvalidURI          string `toml:"invalid_uri"`
+	InvalidPort         string `toml:"invalid_port"`
+	InvalidEnvMap       string `toml:"invalid_env_map"`
+	InvalidEnvOverride  string `toml:"invalid_env_override"`
+	UnknownProfile      string `toml:"unknown_profile"`
 }
 
 type ExitMessages struct {
-	Success       string `toml:"success"`
-	PartialFail   string `toml:"partial_fail"`
-	FullFail      string `toml:"full_fail"`
-	ConfigInstall string `toml:"config_install"`
+	Success             string `toml:"success"`
+	PartialFail         string `toml:"partial_fail"`
+	FullFail            string `toml:"full_fail"`
+	ConfigInstall       string `toml:"config_install"`
+	Interrupted         string `toml:"interrupted"`
+	ConfigEncrypted     string `toml:"config_encrypted"`
+	ConfigDecrypted     string `toml:"config_decrypted"`
+	ConfigValid         string `toml:"config_valid"`
+	ConfigInvalid       string `toml:"config_invalid"`
+	ConfigSet           string `toml:"config_set"`
+	ConnectionAdded     string `toml:"connection_added"`
+	NothingAdded        string `toml:"nothing_added"`
+	ConnectionsImported string `toml:"connections_imported"`
 }
 
 type Locale struct {
@@ -95,6 +211,24 @@ type LogsSection struct {
 	CacheEntryExpired          string `toml:"cache_entry_expired"`
 	EnvDisabled                string `toml:"env_disabled"`
 	QuerySummary               string `toml:"query_summary"`
+	ErrorCommittingTransaction string `toml:"error_committing_transaction"`
+	ApplyingMigration          string `toml:"applying_migration"`
+	RevertingMigration         string `toml:"reverting_migration"`
+	MigrationFailed            string `toml:"migration_failed"`
+	NoPendingMigrations        string `toml:"no_pending_migrations"`
+	MigrationHandled           string `toml:"migration_handled"`
+	QueryTimedOut              string `toml:"query_timed_out"`
+	ConnectionCancelled        string `toml:"connection_cancelled"`
+	ConnectionBusy             string `toml:"connection_busy"`
+	InterruptReceived          string `toml:"interrupt_received"`
+	CommittedBeforeInterrupt   string `toml:"committed_before_interrupt"`
+	NoneCommitted              string `toml:"none_committed_before_interrupt"`
+	RetryingQuery              string `toml:"retrying_query"`
+	RetryBudgetExhausted       string `toml:"retry_budget_exhausted"`
+	DiscoveryFailed            string `toml:"discovery_failed"`
+	DatabasesDiscovered        string `toml:"databases_discovered"`
+	DuplicateConnectionName    string `toml:"duplicate_connection_name"`
+	UnresolvedConnection       string `toml:"unresolved_connection"`
 }
 
 var L *Locale
@@ -110,19 +244,26 @@ func DetectSystemLocale() string {
 	return strings.ReplaceAll(cleanLang, "-", "_")
 }
 
-func Load(localeName string) (*Locale, error) {
+// Default locale, used when the requested one isn't available
+const DefaultLocale = "en-US"
+
+// Loads a locale from the TOML files in fsys. Names are accepted with
+// either separator (pt_BR or pt-BR), falling back to DefaultLocale
+func Load(fsys fs.FS, localeName string) (*Locale, error) {
 	if localeName == "" || strings.ToLower(localeName) == "auto" {
 		localeName = DetectSystemLocale()
 	}
 
-	localePath := filepath.Join("config", "locales", fmt.Sprintf("%s.toml", localeName))
-
-	if _, err := os.Stat(localePath); os.IsNotExist(err) {
-		localePath = filepath.Join("config", "locales", "en_US.toml")
+	localePath := DefaultLocale + ".toml"
+	for _, name := range []string{localeName, strings.ReplaceAll(localeName, "_", "-")} {
+		if _, err := fs.Stat(fsys, name+".toml"); err == nil {
+			localePath = name + ".toml"
+			break
+		}
 	}
 
 	var l Locale
-	if _, err := toml.DecodeFile(localePath, &l); err != nil {
+	if _, err := toml.DecodeFS(fsys, localePath, &l); err != nil {
 		return nil, fmt.Errorf("failed to load locale file %s: %w", localePath, err)
 	}
 
@@ -3,6 +3,7 @@ package logger
 import (
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"ohnitiel/prismatic/internal/config"
@@ -29,6 +30,9 @@ func Setup(cfg config.LoggerConfigs) error {
 	handlers = append(handlers, slog.NewTextHandler(os.Stderr, stdErrOpts))
 
 	if cfg.FileOutput != "" {
+		if err := os.MkdirAll(filepath.Dir(cfg.FileOutput), 0o755); err != nil {
+			return err
+		}
 		logFile, err := os.OpenFile(cfg.FileOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
 		if err != nil {
 			return err
@@ -0,0 +1,98 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+// Matches "0001_create_users.up.sql" and "0001_create_users.down.sql".
+// Files without direction ("0001_create_users.sql") are treated as up migrations
+var fileNamePattern = regexp.MustCompile(`^(\d+)_(.+?)(?:\.(up|down))?\.sql$`)
+
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Loads the numbered SQL migration files from dir, sorted by version
+func Load(dir string) ([]*Migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := fileNamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf(locale.L.Errors.InvalidMigrationFile, entry.Name())
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf(locale.L.Errors.DuplicateMigrationVersion, version)
+		}
+
+		if match[3] == "down" {
+			if m.Down != "" {
+				return nil, fmt.Errorf(locale.L.Errors.DuplicateMigrationVersion, version)
+			}
+			m.Down = string(content)
+		} else {
+			if m.Up != "" {
+				return nil, fmt.Errorf(locale.L.Errors.DuplicateMigrationVersion, version)
+			}
+			m.Up = string(content)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		// A down file alone would be recorded as applied without running
+		if m.Up == "" {
+			return nil, fmt.Errorf(locale.L.Errors.MissingUpMigration, m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Returns the migrations whose version is not in applied, in order
+func Pending(migrations []*Migration, applied map[uint64]bool) []*Migration {
+	var pending []*Migration
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
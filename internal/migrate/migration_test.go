@@ -0,0 +1,87 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ohnitiel/prismatic/internal/locale"
+)
+
+func writeMigrations(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	locale.L = &locale.Locale{}
+
+	dir := writeMigrations(t, map[string]string{
+		"0002_add_email.up.sql":    "ALTER TABLE users ADD email TEXT;",
+		"0002_add_email.down.sql":  "ALTER TABLE users DROP email;",
+		"0001_create_users.sql":    "CREATE TABLE users (id INT);",
+		"0010_seed.up.sql":         "INSERT INTO users VALUES (1);",
+		"README.md":                "ignored",
+		"notes_0003_something.sql": "ignored",
+	})
+
+	migrations, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	want := []uint64{1, 2, 10}
+	if len(migrations) != len(want) {
+		t.Fatalf("Load() returned %d migrations, want %d", len(migrations), len(want))
+	}
+	for i, m := range migrations {
+		if m.Version != want[i] {
+			t.Errorf("migrations[%d].Version = %d, want %d", i, m.Version, want[i])
+		}
+	}
+
+	if migrations[1].Name != "add_email" || migrations[1].Down == "" {
+		t.Errorf("migration 2 = %+v, want name add_email with a down script", migrations[1])
+	}
+	if migrations[0].Down != "" {
+		t.Errorf("migration 1 should have no down script")
+	}
+
+	pending := Pending(migrations, map[uint64]bool{1: true, 10: true})
+	if len(pending) != 1 || pending[0].Version != 2 {
+		t.Errorf("Pending() = %v, want only version 2", pending)
+	}
+}
+
+func TestLoadDuplicateVersion(t *testing.T) {
+	locale.L = &locale.Locale{}
+
+	dir := writeMigrations(t, map[string]string{
+		"0001_create_users.up.sql":  "CREATE TABLE users (id INT);",
+		"0001_create_orders.up.sql": "CREATE TABLE orders (id INT);",
+	})
+
+	if _, err := Load(dir); err == nil {
+		t.Fatal("Load() expected an error for duplicate versions")
+	}
+}
+
+func TestLoadMissingUp(t *testing.T) {
+	locale.L = &locale.Locale{}
+
+	dir := writeMigrations(t, map[string]string{
+		"0001_create_users.up.sql": "CREATE TABLE users (id INT);",
+		"0002_add_email.down.sql":  "ALTER TABLE users DROP email;",
+	})
+
+	if _, err := Load(dir); err == nil {
+		t.Fatal("Load() expected an error for a migration without an up script")
+	}
+}
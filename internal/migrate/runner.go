@@ -0,0 +1,333 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/db"
+	"ohnitiel/prismatic/internal/locale"
+)
+
+// Table used to record the applied migrations on every database
+const TrackingTable = "prismatic_schema_migrations"
+
+var createTrackingTable = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	version BIGINT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`, TrackingTable)
+
+// Runner applies migrations to every connection loaded by the executor
+type Runner struct {
+	executor   *db.Executor
+	conf       *config.Config
+	migrations []*Migration
+}
+
+func NewRunner(executor *db.Executor, conf *config.Config, migrations []*Migration) *Runner {
+	return &Runner{
+		executor:   executor,
+		conf:       conf,
+		migrations: migrations,
+	}
+}
+
+// Applies the pending migrations on every connection.
+// With commit, every migration runs and is committed in its own transaction.
+// Otherwise all pending migrations run in a single transaction that is rolled
+// back, so later migrations can see the changes of earlier ones.
+// Returns the versions applied on each connection
+func (r *Runner) Up(ctx context.Context, commit bool) (map[string][]uint64, map[string]error) {
+	var mu sync.Mutex
+	applied := make(map[string][]uint64)
+
+	errors := r.executor.ForEach(ctx, r.conf.MaxWorkers,
+		func(ctx context.Context, name string, conn *db.Connection) error {
+			current, err := r.appliedVersions(ctx, name, conn)
+			if err != nil {
+				return err
+			}
+
+			pending := Pending(r.migrations, current)
+			if len(pending) == 0 {
+				slog.InfoContext(ctx, locale.L.Logs.NoPendingMigrations, "connection", name)
+				mu.Lock()
+				applied[name] = nil
+				mu.Unlock()
+				return nil
+			}
+
+			done, err := r.apply(ctx, name, conn, commit, pending, false, func(ctx context.Context, tx *sql.Tx, m *Migration) error {
+				slog.InfoContext(ctx, locale.L.Logs.ApplyingMigration,
+					"connection", name, "version", m.Version, "name", m.Name)
+
+				if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+					return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+				}
+				_, err := tx.ExecContext(ctx,
+					fmt.Sprintf("INSERT INTO %s (version, name) VALUES ($1, $2)", TrackingTable),
+					m.Version, m.Name,
+				)
+				return err
+			})
+
+			mu.Lock()
+			applied[name] = done
+			mu.Unlock()
+
+			return err
+		},
+	)
+
+	return applied, errors
+}
+
+// Reverts the last steps applied migrations on every connection, following
+// the same transaction semantics as Up.
+// Returns the versions reverted on each connection
+func (r *Runner) Down(ctx context.Context, commit bool, steps int) (map[string][]uint64, map[string]error) {
+	var mu sync.Mutex
+	reverted := make(map[string][]uint64)
+
+	byVersion := make(map[uint64]*Migration, len(r.migrations))
+	for _, m := range r.migrations {
+		byVersion[m.Version] = m
+	}
+
+	errors := r.executor.ForEach(ctx, r.conf.MaxWorkers,
+		func(ctx context.Context, name string, conn *db.Connection) error {
+			current, err := r.appliedVersions(ctx, name, conn)
+			if err != nil {
+				return err
+			}
+
+			versions := make([]uint64, 0, len(current))
+			for v := range current {
+				versions = append(versions, v)
+			}
+			slices.Sort(versions)
+			slices.Reverse(versions)
+
+			var targets []*Migration
+			for _, v := range versions[:min(max(steps, 0), len(versions))] {
+				m, ok := byVersion[v]
+				if !ok {
+					return fmt.Errorf(locale.L.Errors.UnknownAppliedMigration, v)
+				}
+				if m.Down == "" {
+					return fmt.Errorf(locale.L.Errors.MissingDownMigration, m.Version, m.Name)
+				}
+				targets = append(targets, m)
+			}
+
+			if len(targets) == 0 {
+				slog.InfoContext(ctx, locale.L.Logs.NoPendingMigrations, "connection", name)
+				mu.Lock()
+				reverted[name] = nil
+				mu.Unlock()
+				return nil
+			}
+
+			done, err := r.apply(ctx, name, conn, commit, targets, true, func(ctx context.Context, tx *sql.Tx, m *Migration) error {
+				slog.InfoContext(ctx, locale.L.Logs.RevertingMigration,
+					"connection", name, "version", m.Version, "name", m.Name)
+
+				if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+					return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+				}
+				_, err := tx.ExecContext(ctx,
+					fmt.Sprintf("DELETE FROM %s WHERE version = $1", TrackingTable),
+					m.Version,
+				)
+				return err
+			})
+
+			mu.Lock()
+			reverted[name] = done
+			mu.Unlock()
+
+			return err
+		},
+	)
+
+	return reverted, errors
+}
+
+// Returns the applied versions of every connection
+func (r *Runner) Status(ctx context.Context) (map[string]map[uint64]bool, map[string]error) {
+	var mu sync.Mutex
+	status := make(map[string]map[uint64]bool)
+
+	errors := r.executor.ForEach(ctx, r.conf.MaxWorkers,
+		func(ctx context.Context, name string, conn *db.Connection) error {
+			current, err := r.appliedVersions(ctx, name, conn)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			status[name] = current
+			mu.Unlock()
+
+			return nil
+		},
+	)
+
+	return status, errors
+}
+
+// Runs step for each migration, returning the versions that succeeded.
+// When not committing, a single rolled back transaction is used and no
+// version is reported as done. When committing, each migration only runs
+// while its version is still recorded as applied (or not), as another run
+// may have handled it since the versions were read
+func (r *Runner) apply(
+	ctx context.Context, name string, conn *db.Connection, commit bool,
+	migrations []*Migration, applied bool, step func(ctx context.Context, tx *sql.Tx, m *Migration) error,
+) ([]uint64, error) {
+	if !commit {
+		return nil, conn.WithTransaction(ctx, name, false, nil, func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, createTrackingTable); err != nil {
+				return err
+			}
+			for _, m := range migrations {
+				if err := step(ctx, tx, m); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	// Committed migrations are kept apart from concurrent migrate runs, and
+	// from runs sharing the configured lock name
+	var lock *db.Lock
+	if r.conf.Transaction.Lock {
+		lock = db.NewLock(r.conf.Transaction.LockName, TrackingTable)
+	}
+
+	var done []uint64
+	for _, m := range migrations {
+		handled := false
+		err := conn.WithTransaction(ctx, name, true, nil, func(ctx context.Context, tx *sql.Tx) error {
+			if err := conn.TryLock(ctx, tx, lock); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, createTrackingTable); err != nil {
+				return err
+			}
+
+			current, err := isApplied(ctx, tx, m.Version)
+			if err != nil {
+				return err
+			}
+			if handled = current != applied; handled {
+				return nil
+			}
+			return step(ctx, tx, m)
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, locale.L.Logs.MigrationFailed,
+				"connection", name, "version", m.Version, "error", err)
+			return done, err
+		}
+		if handled {
+			slog.WarnContext(ctx, locale.L.Logs.MigrationHandled, "connection", name, "version", m.Version)
+			continue
+		}
+		done = append(done, m.Version)
+	}
+
+	return done, nil
+}
+
+// Reports whether version is recorded as applied
+func isApplied(ctx context.Context, tx *sql.Tx, version uint64) (bool, error) {
+	var count int
+	err := tx.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT count(*) FROM %s WHERE version = $1", TrackingTable),
+		version,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// Reads the applied versions inside a rolled back transaction, so the
+// tracking table is never left behind by a read
+func (r *Runner) appliedVersions(ctx context.Context, name string, conn *db.Connection) (map[uint64]bool, error) {
+	applied := make(map[uint64]bool)
+
+	err := conn.WithTransaction(ctx, name, false, nil, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, createTrackingTable); err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT version FROM %s", TrackingTable))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var version uint64
+			if err := rows.Scan(&version); err != nil {
+				return err
+			}
+			applied[version] = true
+		}
+
+		return rows.Err()
+	})
+
+	return applied, err
+}
+
+// Writes the connection × version status matrix
+func PrintStatus(
+	w io.Writer, migrations []*Migration,
+	status map[string]map[uint64]bool, errors map[string]error,
+) {
+	names := make([]string, 0, len(status)+len(errors))
+	for name := range status {
+		names = append(names, name)
+	}
+	for name := range errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprint(tw, locale.L.CLI.MigrationStatus.Connection)
+	for _, m := range migrations {
+		fmt.Fprintf(tw, "\t%d", m.Version)
+	}
+	fmt.Fprintln(tw)
+
+	for _, name := range names {
+		fmt.Fprint(tw, name)
+
+		if err, ok := errors[name]; ok {
+			fmt.Fprintf(tw, "\t%s: %v\n", locale.L.CLI.MigrationStatus.Error, err)
+			continue
+		}
+
+		for _, m := range migrations {
+			if status[name][m.Version] {
+				fmt.Fprintf(tw, "\t%s", locale.L.CLI.MigrationStatus.Applied)
+			} else {
+				fmt.Fprintf(tw, "\t%s", locale.L.CLI.MigrationStatus.Pending)
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+
+	tw.Flush()
+}
@@ -0,0 +1,114 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"ohnitiel/prismatic/internal/config"
+	"ohnitiel/prismatic/internal/db"
+	"ohnitiel/prismatic/internal/locale"
+)
+
+// Returns a runner over two empty SQLite databases
+func newSQLiteRunner(t *testing.T, migrations []*Migration) (*Runner, *db.Manager) {
+	t.Helper()
+
+	dir := t.TempDir()
+	conf := config.NewConfig()
+	conf.MaxWorkers, conf.MaxRetries = 2, 1
+	conf.Paths.Connections = filepath.Join(dir, "connections.toml")
+	conf.Connections = make(map[string]*config.Connection)
+	for _, name := range []string{"site_a", "site_b"} {
+		if err := os.WriteFile(filepath.Join(dir, name+".db"), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		conf.Connections[name] = &config.Connection{Engine: "sqlite", Environment: map[string]*config.Environment{
+			"production": {Database: name + ".db"},
+		}}
+	}
+
+	manager := db.NewDatabaseManager()
+	t.Cleanup(manager.Close)
+	manager.LoadConnections(context.Background(), conf, "production", nil)
+
+	return NewRunner(db.NewExecutor(manager), conf, migrations), manager
+}
+
+func TestRunner(t *testing.T) {
+	locale.L = &locale.Locale{}
+	locale.L.CLI.MigrationStatus.Connection = "connection"
+	locale.L.CLI.MigrationStatus.Applied = "applied"
+	locale.L.CLI.MigrationStatus.Pending = "pending"
+
+	migrations := []*Migration{
+		{Version: 1, Name: "create_users", Up: "CREATE TABLE users (id INTEGER)", Down: "DROP TABLE users"},
+		{Version: 2, Name: "add_email", Up: "ALTER TABLE users ADD email TEXT", Down: "ALTER TABLE users DROP COLUMN email"},
+		{Version: 3, Name: "broken", Up: "INSERT INTO missing VALUES (1)"},
+	}
+	runner, _ := newSQLiteRunner(t, migrations[:2])
+	ctx := context.Background()
+
+	// A dry run applies every migration in one transaction, then rolls it back
+	applied, failures := runner.Up(ctx, false)
+	if len(failures) != 0 || applied["site_a"] != nil {
+		t.Fatalf("Up() dry run = %v, %v", applied, failures)
+	}
+	status, _ := runner.Status(ctx)
+	if len(status["site_a"]) != 0 {
+		t.Errorf("Status() = %v after a dry run, want nothing applied", status)
+	}
+
+	// Each migration is committed on its own, so the ones before a failure stay
+	runner.migrations = migrations
+	applied, failures = runner.Up(ctx, true)
+	if want := []uint64{1, 2}; !reflect.DeepEqual(applied["site_a"], want) || failures["site_a"] == nil {
+		t.Errorf("Up() = %v, %v, want %v applied before the failure", applied, failures, want)
+	}
+	status, _ = runner.Status(ctx)
+	if want := map[uint64]bool{1: true, 2: true}; !reflect.DeepEqual(status["site_b"], want) {
+		t.Errorf("Status() = %v, want %v", status["site_b"], want)
+	}
+
+	runner.migrations = migrations[:2]
+	reverted, failures := runner.Down(ctx, true, 1)
+	if want := []uint64{2}; len(failures) != 0 || !reflect.DeepEqual(reverted["site_a"], want) {
+		t.Errorf("Down() = %v, %v, want %v reverted", reverted, failures, want)
+	}
+	status, failures = runner.Status(ctx)
+
+	var out strings.Builder
+	PrintStatus(&out, runner.migrations, status, failures)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || strings.Fields(lines[0])[0] != "connection" ||
+		!reflect.DeepEqual(strings.Fields(lines[1]), []string{"site_a", "applied", "pending"}) {
+		t.Errorf("PrintStatus() =\n%s", out.String())
+	}
+}
+
+// A migration handled by another run after the versions were read is
+// skipped instead of running again
+func TestApplySkipsHandledMigrations(t *testing.T) {
+	locale.L = &locale.Locale{}
+
+	m := &Migration{Version: 1, Name: "create_users", Up: "CREATE TABLE users (id INTEGER)"}
+	runner, manager := newSQLiteRunner(t, []*Migration{m})
+	ctx := context.Background()
+	if _, failures := runner.Up(ctx, true); len(failures) != 0 {
+		t.Fatalf("Up() failures = %v", failures)
+	}
+
+	conn := manager.GetConnection("site_a")
+	done, err := runner.apply(ctx, "site_a", conn, true, []*Migration{m}, false,
+		func(ctx context.Context, tx *sql.Tx, m *Migration) error {
+			t.Error("apply() ran a migration that is already applied")
+			return nil
+		})
+	if err != nil || len(done) != 0 {
+		t.Errorf("apply() = %v, %v, want the migration skipped", done, err)
+	}
+}
@@ -0,0 +1,33 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Reads the secret from the output of a command, e.g. a password manager
+// (cmd:pass show db/prod). The command is not run through a shell and only
+// the first line of its output is used
+type CommandProvider struct{}
+
+func (CommandProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	line, _, _ := strings.Cut(string(output), "\n")
+	return strings.TrimRight(line, "\r"), nil
+}
@@ -0,0 +1,223 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// Prefix of encrypted values, after the "enc:" scheme
+	encryptedVersion = "v1:"
+	// First line of a fully encrypted file
+	FileHeader = "# prismatic-encrypted v1"
+
+	saltSize = 16
+	keySize  = 32
+)
+
+var ErrNoKey = errors.New("no encryption key: set PRISMATIC_PASSPHRASE or a key file")
+
+// Returns the key material used to derive encryption keys: the
+// PRISMATIC_PASSPHRASE variable, or the contents of keyFile (falling back
+// to PRISMATIC_KEY_FILE)
+func KeyMaterial(keyFile string) ([]byte, error) {
+	if passphrase := os.Getenv("PRISMATIC_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	if keyFile == "" {
+		keyFile = os.Getenv("PRISMATIC_KEY_FILE")
+	}
+	if keyFile == "" {
+		return nil, ErrNoKey
+	}
+
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(content, "\r\n"), nil
+}
+
+// Cipher encrypts with AES-256-GCM using a key derived with scrypt.
+// A cipher uses a single salt when encrypting, so a whole file only pays
+// for one key derivation, and caches the keys derived for decryption
+type Cipher struct {
+	material []byte
+	salt     []byte
+
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func NewCipher(material []byte) (*Cipher, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &Cipher{material: material, salt: salt, keys: make(map[string][]byte)}, nil
+}
+
+func (c *Cipher) gcm(salt []byte) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, ok := c.keys[string(salt)]
+	if !ok {
+		var err error
+		key, err = scrypt.Key(c.material, salt, 1<<15, 8, 1, keySize)
+		if err != nil {
+			return nil, err
+		}
+		c.keys[string(salt)] = key
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns base64(salt | nonce | ciphertext)
+func (c *Cipher) Encrypt(plaintext []byte) (string, error) {
+	gcm, err := c.gcm(c.salt)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := append(append([]byte{}, c.salt...), nonce...)
+	sealed = gcm.Seal(sealed, nonce, plaintext, nil)
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (c *Cipher) Decrypt(encoded string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < saltSize {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+
+	gcm, err := c.gcm(sealed[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	sealed = sealed[saltSize:]
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrong key or corrupted value")
+	}
+	return plaintext, nil
+}
+
+// Returns the "enc:v1:..." reference for a plaintext value
+func (c *Cipher) EncryptValue(plaintext string) (string, error) {
+	encrypted, err := c.Encrypt([]byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return "enc:" + encryptedVersion + encrypted, nil
+}
+
+// Reports whether value is an "enc:" reference
+func IsEncryptedValue(value string) bool {
+	return strings.HasPrefix(value, "enc:"+encryptedVersion)
+}
+
+// Decrypts an "enc:v1:..." reference
+func (c *Cipher) DecryptValue(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, "enc:"+encryptedVersion)
+	if !ok {
+		return "", fmt.Errorf("unsupported encrypted value")
+	}
+
+	plaintext, err := c.Decrypt(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Reports whether data is a fully encrypted file
+func IsEncryptedFile(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(FileHeader))
+}
+
+// Encrypts a whole file, keeping the header so it can be recognized
+func (c *Cipher) EncryptFile(data []byte) ([]byte, error) {
+	encrypted, err := c.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var out strings.Builder
+	out.WriteString(FileHeader + "\n")
+	for len(encrypted) > 76 {
+		out.WriteString(encrypted[:76] + "\n")
+		encrypted = encrypted[76:]
+	}
+	out.WriteString(encrypted + "\n")
+
+	return []byte(out.String()), nil
+}
+
+func (c *Cipher) DecryptFile(data []byte) ([]byte, error) {
+	body, ok := bytes.CutPrefix(data, []byte(FileHeader))
+	if !ok {
+		return nil, fmt.Errorf("not an encrypted file")
+	}
+	return c.Decrypt(strings.Join(strings.Fields(string(body)), ""))
+}
+
+// Decrypts "enc:v1:..." values, loading the key on first use
+type EncryptedProvider struct {
+	keyFile string
+
+	once   sync.Once
+	cipher *Cipher
+	err    error
+}
+
+func NewEncryptedProvider(keyFile string) *EncryptedProvider {
+	return &EncryptedProvider{keyFile: keyFile}
+}
+
+func (p *EncryptedProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	p.once.Do(func() {
+		var material []byte
+		material, p.err = KeyMaterial(p.keyFile)
+		if p.err == nil {
+			p.cipher, p.err = NewCipher(material)
+		}
+	})
+	if p.err != nil {
+		return "", p.err
+	}
+
+	return p.cipher.DecryptValue("enc:" + ref)
+}
@@ -0,0 +1,120 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Provider resolves the secret referenced by ref, the part of a value after
+// its "scheme:" prefix
+type Provider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+var (
+	mu        sync.Mutex
+	providers = map[string]Provider{
+		"env":   EnvProvider{},
+		"file":  FileProvider{},
+		"cmd":   CommandProvider{},
+		"vault": NewVaultProvider(),
+		"enc":   NewEncryptedProvider(""),
+	}
+	// Resolved values, so a reference shared by many connections is only
+	// resolved once per run
+	cache = make(map[string]string)
+)
+
+// Registers a provider for values prefixed with "scheme:", replacing any
+// provider previously registered for it
+func Register(scheme string, provider Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	providers[scheme] = provider
+	cache = make(map[string]string)
+}
+
+// Returns the provider and reference of value, if it is a secret reference
+func parse(value string) (Provider, string, bool) {
+	if strings.HasPrefix(value, "${") && strings.HasSuffix(value, "}") {
+		return EnvProvider{}, strings.TrimSuffix(strings.TrimPrefix(value, "${"), "}"), true
+	}
+
+	scheme, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, "", false
+	}
+	provider, ok := providers[scheme]
+	return provider, ref, ok
+}
+
+// Reports whether value references a secret instead of holding it
+func IsReference(value string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, _, ok := parse(value)
+	return ok
+}
+
+// Resolves value when it is a secret reference ("${VAR}" or "scheme:ref"
+// with a registered scheme). Any other value is returned unchanged
+func Resolve(ctx context.Context, value string) (string, error) {
+	mu.Lock()
+	provider, ref, ok := parse(value)
+	cached, found := cache[value]
+	mu.Unlock()
+
+	if !ok {
+		return value, nil
+	}
+	if found {
+		return cached, nil
+	}
+
+	secret, err := provider.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("resolving secret %q: %w", redact(value), err)
+	}
+
+	mu.Lock()
+	cache[value] = secret
+	mu.Unlock()
+
+	return secret, nil
+}
+
+// Keeps only the scheme of a reference, so errors never leak its arguments
+func redact(value string) string {
+	if scheme, _, ok := strings.Cut(value, ":"); ok {
+		return scheme + ":…"
+	}
+	return value
+}
+
+// Reads the secret from an environment variable (env:VAR or ${VAR})
+type EnvProvider struct{}
+
+func (EnvProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return value, nil
+}
+
+// Reads the secret from a file, e.g. a Docker or Kubernetes secret
+// (file:/run/secrets/db). A trailing newline is ignored
+type FileProvider struct{}
+
+func (FileProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	content, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
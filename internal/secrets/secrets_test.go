@@ -0,0 +1,90 @@
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("PRISMATIC_TEST_SECRET", "from-env")
+
+	secretFile := filepath.Join(t.TempDir(), "db")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain-password", "plain-password"},
+		{"unknown:scheme", "unknown:scheme"},
+		{"${PRISMATIC_TEST_SECRET}", "from-env"},
+		{"env:PRISMATIC_TEST_SECRET", "from-env"},
+		{"file:" + secretFile, "from-file"},
+		{"cmd:echo from-cmd", "from-cmd"},
+	}
+
+	for _, tt := range tests {
+		got, err := Resolve(ctx, tt.value)
+		if err != nil {
+			t.Errorf("Resolve(%q) error = %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Resolve(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+
+	if _, err := Resolve(ctx, "env:PRISMATIC_TEST_MISSING"); err == nil {
+		t.Error("Resolve() of an unset variable should fail")
+	}
+}
+
+func TestVaultProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/db":
+			w.Write([]byte(`{"data": {"data": {"password": "from-kv2"}}}`))
+		case "/v1/kv/db":
+			w.Write([]byte(`{"data": {"password": "from-kv1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	Register("vault", &VaultProvider{Address: server.URL, Token: "token", Client: server.Client()})
+	defer Register("vault", NewVaultProvider())
+
+	for value, want := range map[string]string{
+		"vault:secret/data/db#password": "from-kv2",
+		"vault:kv/db#password":          "from-kv1",
+	} {
+		got, err := Resolve(context.Background(), value)
+		if err != nil || got != want {
+			t.Errorf("Resolve(%q) = (%q, %v), want %q", value, got, err, want)
+		}
+	}
+
+	if _, err := Resolve(context.Background(), "vault:missing#password"); err == nil {
+		t.Error("Resolve() of a missing vault path should fail")
+	}
+
+	// Set after the provider is built, as when loaded from .env
+	provider := &VaultProvider{Client: server.Client()}
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+	if got, err := provider.Resolve(context.Background(), "kv/db#password"); err != nil || got != "from-kv1" {
+		t.Errorf("Resolve() = (%q, %v), want the environment read when resolving", got, err)
+	}
+}
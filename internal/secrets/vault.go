@@ -0,0 +1,81 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reads the secret from a Vault-compatible HTTP service
+// (vault:secret/data/db#password). Both KV v1 and v2 responses are accepted
+type VaultProvider struct {
+	Address string // Defaults to VAULT_ADDR
+	Token   string // Defaults to VAULT_TOKEN
+	Client  *http.Client
+}
+
+// Returns a provider configured from VAULT_ADDR and VAULT_TOKEN. They are
+// read when resolving, so they may be set in the .env file
+func NewVaultProvider() *VaultProvider {
+	return &VaultProvider{Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (v *VaultProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	address, token := v.Address, v.Token
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if address == "" {
+		return "", fmt.Errorf("vault address is not set (VAULT_ADDR)")
+	}
+
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return "", fmt.Errorf("vault reference must be PATH#FIELD")
+	}
+
+	url := strings.TrimRight(address, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	data := body.Data
+	// KV v2 nests the secret under data.data
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("field %s not found", field)
+	}
+	return value, nil
+}
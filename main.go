@@ -3,12 +3,10 @@ package main
 import (
 	"embed"
 	"log"
-	"log/slog"
 
 	"ohnitiel/prismatic/cmd/cli"
 	"ohnitiel/prismatic/internal/config"
 	"ohnitiel/prismatic/internal/locale"
-	"ohnitiel/prismatic/internal/logger"
 )
 
 //go:embed config/locales/*
@@ -17,19 +15,18 @@ import (
 var cfgPath embed.FS
 
 func main() {
-	cfg, err := config.FromFile("./config/config.toml")
+	cfg := config.NewConfig()
 	cfg.Installer = config.NewInstaller(cfgPath)
-	if err != nil {
-		log.Fatal(err)
-	}
 
-	if err := logger.Setup(cfg.Logging); err != nil {
-		log.Fatal(err)
+	// Built-in locale for the help, in the language of the discovered
+	// configuration. The configuration itself is loaded once the command
+	// line is parsed, from the --config and --profile given
+	if path, err := config.Discover(""); err == nil {
+		cfg.Locale = config.PeekLocale(path)
 	}
-
-	locale.L, err = locale.Load(cfg.Locale)
-	if err != nil {
-		slog.Error("Failed to load locale", "error", err)
+	var err error
+	if locale.L, err = cfg.LoadLocale(); err != nil {
+		log.Fatal(err)
 	}
 
 	cli.Prismatic(cfg)